@@ -0,0 +1,436 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Fixed ids so that re-imported decks update the existing note type and deck instead of duplicating them.
+const ankiModelID int64 = 1717171717001
+const ankiDeckID int64 = 1717171717002
+const ankiDeckName = "Kscribbler"
+
+// Kobo stores highlight colors as integers in Bookmark.Color.
+var highlightColors = map[string]int{
+	"yellow": 0,
+	"pink":   1,
+	"blue":   2,
+	"green":  3,
+}
+
+var ankiDirectiveRegex = regexp.MustCompile(`(?i)kscrib:\s*anki`)
+
+const ankiSchema = `
+CREATE TABLE col (
+	id integer primary key, crt integer not null, mod integer not null, scm integer not null,
+	ver integer not null, dty integer not null, usn integer not null, ls integer not null,
+	conf text not null, models text not null, decks text not null, dconf text not null, tags text not null
+);
+CREATE TABLE notes (
+	id integer primary key, guid text not null, mid integer not null, mod integer not null,
+	usn integer not null, tags text not null, flds text not null, sfld integer not null,
+	csum integer not null, flags integer not null, data text not null
+);
+CREATE TABLE cards (
+	id integer primary key, nid integer not null, did integer not null, ord integer not null,
+	mod integer not null, usn integer not null, type integer not null, queue integer not null,
+	due integer not null, ivl integer not null, factor integer not null, reps integer not null,
+	lapses integer not null, left integer not null, odue integer not null, odid integer not null,
+	flags integer not null, data text not null
+);
+CREATE TABLE revlog (
+	id integer primary key, cid integer not null, usn integer not null, ease integer not null,
+	ivl integer not null, lastIvl integer not null, factor integer not null, time integer not null,
+	type integer not null
+);
+CREATE TABLE graves (usn integer not null, oid integer not null, type integer not null);
+CREATE INDEX ix_notes_usn on notes (usn);
+CREATE INDEX ix_cards_usn on cards (usn);
+CREATE INDEX ix_revlog_usn on revlog (usn);
+CREATE INDEX ix_cards_nid on cards (nid);
+CREATE INDEX ix_cards_sched on cards (did, queue, due);
+CREATE INDEX ix_revlog_cid on revlog (cid);
+CREATE INDEX ix_notes_csum on notes (csum);
+`
+
+// loadAnkiCards selects highlights tagged with a `kscrib:anki` note or, when color is set, highlights of that color.
+// SQL only narrows the candidates down to notes mentioning kscrib:, ankiDirectiveRegex decides.
+func loadAnkiCards(color string) ([]AnkiCard, error) {
+	colorFilter := -1
+	if color != "" {
+		value, ok := highlightColors[strings.ToLower(color)]
+		if !ok {
+			return nil, fmt.Errorf("unknown highlight color %q, expected yellow, pink, blue or green", color)
+		}
+		colorFilter = value
+	}
+
+	var candidates []AnkiCard
+	err := kscribblerDB.Select(&candidates, `
+		SELECT
+			q.bookmark_id,
+			q.quote,
+			q.annotation,
+			q.color,
+			q.page,
+			b.book_title
+		FROM quote q
+		LEFT JOIN book b ON b.book_id = q.book_id
+		WHERE q.annotation LIKE '%kscrib:%'
+		OR (? >= 0 AND q.color = ?)
+		ORDER BY q.book_id, q.page, q.bookmark_id;
+	`, colorFilter, colorFilter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load quotes for anki export: %w", err)
+	}
+
+	var cards []AnkiCard
+	for _, card := range candidates {
+		colored := colorFilter >= 0 && card.Color.Valid && card.Color.Int64 == int64(colorFilter)
+		if colored || ankiDirectiveRegex.MatchString(card.Annotation.String) {
+			cards = append(cards, card)
+		}
+	}
+	return cards, nil
+}
+
+// loadAnkiVocabulary selects the words looked up in Nickel's dictionary (the WordList table of KoboReader.sqlite),
+// one card per word with the book it was first looked up in.
+func loadAnkiVocabulary() []AnkiCard {
+	if _, err := os.Stat(koboDBPath); err != nil {
+		slog.Info("No KoboReader.sqlite, skipping vocabulary", "path", koboDBPath)
+		return nil
+	}
+
+	koboDB, err := sqlx.Open("sqlite", "file:"+koboDBPath+"?mode=ro")
+	if err != nil {
+		slog.Error("failed to open KoboReader.sqlite for vocabulary", "error", err)
+		return nil
+	}
+	defer koboDB.Close()
+
+	var cards []AnkiCard
+	err = koboDB.Select(&cards, `
+		SELECT
+			'word:' || lower(TRIM(w.Text)) AS bookmark_id,
+			TRIM(w.Text) AS quote,
+			(SELECT c.Title FROM content c WHERE c.ContentID = w.VolumeId LIMIT 1) AS book_title
+		FROM WordList w
+		WHERE TRIM(COALESCE(w.Text, '')) != ''
+		AND w.DateCreated = (
+			SELECT MIN(first.DateCreated) FROM WordList first
+			WHERE lower(TRIM(first.Text)) = lower(TRIM(w.Text))
+		)
+		GROUP BY lower(TRIM(w.Text))
+		ORDER BY w.DateCreated;
+	`)
+	if err != nil {
+		// firmware without a dictionary history has no WordList table
+		slog.Warn("failed to load vocabulary from KoboReader.sqlite", "error", err)
+		return nil
+	}
+	return cards
+}
+
+// ankiGUID derives a stable note GUID from the bookmark so re-exports update existing cards.
+func ankiGUID(bookmarkID string) string {
+	sum := sha1.Sum([]byte("kscribbler:" + bookmarkID))
+	return hex.EncodeToString(sum[:10])
+}
+
+// ankiNoteID derives a stable positive note id from the bookmark.
+func ankiNoteID(bookmarkID string) int64 {
+	sum := sha1.Sum([]byte("kscribbler-note:" + bookmarkID))
+	return int64(binary.BigEndian.Uint64(sum[:8]) >> 12)
+}
+
+// ankiChecksum mirrors Anki's duplicate-detection checksum of the sort field.
+func ankiChecksum(field string) int64 {
+	sum := sha1.Sum([]byte(field))
+	value, _ := strconv.ParseInt(hex.EncodeToString(sum[:4]), 16, 64)
+	return value
+}
+
+// fields renders the front and back of the card.
+func (card AnkiCard) fields() (string, string) {
+	front := html.EscapeString(strings.TrimSpace(card.Quote))
+
+	var back []string
+	annotation := strings.TrimSpace(ankiDirectiveRegex.ReplaceAllString(card.Annotation.String, ""))
+	if annotation != "" {
+		back = append(back, html.EscapeString(annotation))
+	}
+
+	source := fmt.Sprintf("<i>%s</i>", html.EscapeString(card.Title.String))
+	if card.Page.Valid && card.Page.Int64 > 0 {
+		source += fmt.Sprintf(", p. %d", card.Page.Int64)
+	}
+	back = append(back, source)
+
+	return front, strings.Join(back, "<br><br>")
+}
+
+// ankiCollectionJSON builds the conf, models, decks and dconf columns of the col table.
+func ankiCollectionJSON(now int64) ([]string, error) {
+	models := map[string]any{
+		strconv.FormatInt(ankiModelID, 10): map[string]any{
+			"id":        ankiModelID,
+			"name":      "Kscribbler Highlight",
+			"type":      0,
+			"mod":       now,
+			"usn":       -1,
+			"sortf":     0,
+			"did":       ankiDeckID,
+			"tags":      []string{},
+			"vers":      []int{},
+			"latexPre":  "\\documentclass[12pt]{article}\n\\special{papersize=3in,5in}\n\\usepackage{amssymb,amsmath}\n\\pagestyle{empty}\n\\setlength{\\parindent}{0in}\n\\begin{document}\n",
+			"latexPost": "\\end{document}",
+			"css":       ".card { font-family: serif; font-size: 20px; text-align: left; color: black; background-color: white; }",
+			"req":       []any{[]any{0, "any", []int{0}}},
+			"flds": []map[string]any{
+				{"name": "Front", "ord": 0, "sticky": false, "rtl": false, "font": "Arial", "size": 20, "media": []string{}},
+				{"name": "Back", "ord": 1, "sticky": false, "rtl": false, "font": "Arial", "size": 20, "media": []string{}},
+			},
+			"tmpls": []map[string]any{
+				{
+					"name":  "Highlight",
+					"ord":   0,
+					"qfmt":  "{{Front}}",
+					"afmt":  "{{FrontSide}}<hr id=answer>{{Back}}",
+					"did":   nil,
+					"bqfmt": "",
+					"bafmt": "",
+				},
+			},
+		},
+	}
+
+	deck := func(id int64, name string) map[string]any {
+		return map[string]any{
+			"id":               id,
+			"name":             name,
+			"mod":              now,
+			"usn":              -1,
+			"desc":             "",
+			"dyn":              0,
+			"conf":             1,
+			"collapsed":        false,
+			"extendNew":        10,
+			"extendRev":        50,
+			"newToday":         []int{0, 0},
+			"revToday":         []int{0, 0},
+			"lrnToday":         []int{0, 0},
+			"timeToday":        []int{0, 0},
+			"browserCollapsed": false,
+		}
+	}
+	decks := map[string]any{
+		"1":                               deck(1, "Default"),
+		strconv.FormatInt(ankiDeckID, 10): deck(ankiDeckID, ankiDeckName),
+	}
+
+	dconf := map[string]any{
+		"1": map[string]any{
+			"id":       1,
+			"name":     "Default",
+			"mod":      0,
+			"usn":      0,
+			"maxTaken": 60,
+			"autoplay": true,
+			"timer":    0,
+			"replayq":  true,
+			"dyn":      false,
+			"new": map[string]any{
+				"delays":        []int{1, 10},
+				"ints":          []int{1, 4, 7},
+				"initialFactor": 2500,
+				"order":         1,
+				"perDay":        20,
+				"bury":          true,
+				"separate":      true,
+			},
+			"lapse": map[string]any{
+				"delays":      []int{10},
+				"mult":        0,
+				"minInt":      1,
+				"leechFails":  8,
+				"leechAction": 0,
+			},
+			"rev": map[string]any{
+				"perDay":   100,
+				"ease4":    1.3,
+				"fuzz":     0.05,
+				"minSpace": 1,
+				"ivlFct":   1,
+				"maxIvl":   36500,
+				"bury":     true,
+			},
+		},
+	}
+
+	conf := map[string]any{
+		"nextPos":       1,
+		"estTimes":      true,
+		"activeDecks":   []int64{1},
+		"sortType":      "noteFld",
+		"timeLim":       0,
+		"sortBackwards": false,
+		"addToCur":      true,
+		"curDeck":       1,
+		"newBury":       true,
+		"newSpread":     0,
+		"dueCounts":     true,
+		"curModel":      strconv.FormatInt(ankiModelID, 10),
+		"collapseTime":  1200,
+	}
+
+	var columns []string
+	for _, column := range []any{conf, models, decks, dconf} {
+		b, err := json.Marshal(column)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode anki collection: %w", err)
+		}
+		columns = append(columns, string(b))
+	}
+	return columns, nil
+}
+
+// writeAnkiCollection creates the collection.anki2 SQLite database containing one note per card.
+func writeAnkiCollection(path string, cards []AnkiCard) error {
+	collection, err := sqlx.Open("sqlite", path)
+	if err != nil {
+		return fmt.Errorf("failed to create anki collection %s: %w", path, err)
+	}
+	defer collection.Close()
+
+	if _, err := collection.Exec(ankiSchema); err != nil {
+		return fmt.Errorf("failed to create anki collection schema: %w", err)
+	}
+
+	now := time.Now().Unix()
+	columns, err := ankiCollectionJSON(now)
+	if err != nil {
+		return err
+	}
+	_, err = collection.Exec(
+		`INSERT INTO col VALUES (1, ?, ?, ?, 11, 0, 0, 0, ?, ?, ?, ?, '{}');`,
+		now, now*1000, now*1000, columns[0], columns[1], columns[2], columns[3],
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write anki collection: %w", err)
+	}
+
+	for i, card := range cards {
+		front, back := card.fields()
+		noteID := ankiNoteID(card.BookmarkID)
+
+		_, err := collection.Exec(
+			`INSERT INTO notes VALUES (?, ?, ?, ?, -1, ' kscribbler ', ?, ?, ?, 0, '');`,
+			noteID,
+			ankiGUID(card.BookmarkID),
+			ankiModelID,
+			now,
+			front+"\x1f"+back,
+			front,
+			ankiChecksum(front),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to write anki note for %s: %w", card.BookmarkID, err)
+		}
+
+		_, err = collection.Exec(
+			`INSERT INTO cards VALUES (?, ?, ?, 0, ?, -1, 0, 0, ?, 0, 0, 0, 0, 0, 0, 0, 0, '');`,
+			noteID,
+			noteID,
+			ankiDeckID,
+			now,
+			i+1,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to write anki card for %s: %w", card.BookmarkID, err)
+		}
+	}
+	return nil
+}
+
+// writeAnkiPackage zips the collection and an empty media list into an .apkg at outputPath.
+func writeAnkiPackage(outputPath string, collectionPath string) error {
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create anki deck %s: %w", outputPath, err)
+	}
+	defer out.Close()
+
+	collectionFile, err := os.Open(collectionPath)
+	if err != nil {
+		return fmt.Errorf("failed to read anki collection: %w", err)
+	}
+	defer collectionFile.Close()
+
+	archive := zip.NewWriter(out)
+	entry, err := archive.Create("collection.anki2")
+	if err != nil {
+		return fmt.Errorf("failed to write anki package: %w", err)
+	}
+	if _, err := io.Copy(entry, collectionFile); err != nil {
+		return fmt.Errorf("failed to write anki package: %w", err)
+	}
+
+	media, err := archive.Create("media")
+	if err != nil {
+		return fmt.Errorf("failed to write anki package: %w", err)
+	}
+	if _, err := media.Write([]byte("{}")); err != nil {
+		return fmt.Errorf("failed to write anki package: %w", err)
+	}
+
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("failed to finalize anki package: %w", err)
+	}
+	return out.Close()
+}
+
+// exportAnki writes an Anki .apkg deck of the selected highlights, and with vocabulary the words looked up in
+// the dictionary, to outputPath.
+func exportAnki(outputPath string, color string, vocabulary bool) error {
+	cards, err := loadAnkiCards(color)
+	if err != nil {
+		return err
+	}
+	highlights := len(cards)
+	if vocabulary {
+		cards = append(cards, loadAnkiVocabulary()...)
+	}
+	slog.Info("Exporting highlights to Anki", "highlights", highlights, "words", len(cards)-highlights, "deck", outputPath)
+
+	tmpDir, err := os.MkdirTemp("", "kscribbler-anki")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory for anki export: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	collectionPath := tmpDir + "/collection.anki2"
+	if err := writeAnkiCollection(collectionPath, cards); err != nil {
+		return err
+	}
+	if err := writeAnkiPackage(outputPath, collectionPath); err != nil {
+		return err
+	}
+
+	slog.Info("Anki deck written", "path", outputPath)
+	return nil
+}
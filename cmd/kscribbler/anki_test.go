@@ -0,0 +1,130 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestExportAnki(t *testing.T) {
+	dir := t.TempDir()
+	defer func(path string) { kscribblerDBPath = path }(kscribblerDBPath)
+	kscribblerDBPath = filepath.Join(dir, "kscribbler.sqlite")
+	createKscribblerTables()
+	migrateKscribblerTables()
+
+	kscribblerDB = connectKscribblerDB()
+	defer kscribblerDB.Close()
+	_, err := kscribblerDB.Exec(`
+		INSERT INTO book (book_id, book_title) VALUES ('book1', 'Crooked Kingdom');
+		INSERT INTO quote (book_id, bookmark_id, quote, annotation, page, color) VALUES
+			('book1', 'tagged', 'No mourners.', 'kscrib:anki', 12, 0),
+			('book1', 'spaced', 'No funerals.', 'Remember this KSCRIB: anki', NULL, 0),
+			('book1', 'blue', 'Blue highlight.', NULL, 40, 2),
+			('book1', 'other', 'Not exported.', 'kscrib:skip', 50, 0),
+			('book1', 'plain', 'Not exported either.', NULL, 60, 0);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deck := filepath.Join(dir, "deck.apkg")
+	if err := exportAnki(deck, "blue", false); err != nil {
+		t.Fatalf("exportAnki() error = %v", err)
+	}
+
+	archive, err := zip.OpenReader(deck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	var names []string
+	collectionPath := filepath.Join(dir, "collection.anki2")
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+		if file.Name != "collection.anki2" {
+			continue
+		}
+		src, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst, err := os.Create(collectionPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(dst, src); err != nil {
+			t.Fatal(err)
+		}
+		src.Close()
+		dst.Close()
+	}
+	if want := []string{"collection.anki2", "media"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("package files = %q, want %q", names, want)
+	}
+
+	collection, err := sqlx.Open("sqlite", collectionPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collection.Close()
+
+	var notes []struct {
+		ID     int64  `db:"id"`
+		GUID   string `db:"guid"`
+		Fields string `db:"flds"`
+	}
+	if err := collection.Select(&notes, `SELECT id, guid, flds FROM notes ORDER BY sfld;`); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"blue":   {"Blue highlight.", "<i>Crooked Kingdom</i>, p. 40"},
+		"spaced": {"No funerals.", "Remember this<br><br><i>Crooked Kingdom</i>"},
+		"tagged": {"No mourners.", "<i>Crooked Kingdom</i>, p. 12"},
+	}
+	if len(notes) != len(want) {
+		t.Fatalf("deck has %d notes, want %d", len(notes), len(want))
+	}
+	for _, note := range notes {
+		var bookmarkID string
+		for id := range want {
+			if ankiGUID(id) == note.GUID {
+				bookmarkID = id
+			}
+		}
+		if bookmarkID == "" {
+			t.Errorf("note %q was not expected", note.Fields)
+			continue
+		}
+		if note.ID != ankiNoteID(bookmarkID) {
+			t.Errorf("note id of %s = %d, want %d", bookmarkID, note.ID, ankiNoteID(bookmarkID))
+		}
+		if fields := strings.Split(note.Fields, "\x1f"); !reflect.DeepEqual(fields, want[bookmarkID]) {
+			t.Errorf("fields of %s = %q, want %q", bookmarkID, fields, want[bookmarkID])
+		}
+
+		var cards []struct {
+			DeckID int64 `db:"did"`
+		}
+		if err := collection.Select(&cards, `SELECT did FROM cards WHERE nid = ?;`, note.ID); err != nil {
+			t.Fatal(err)
+		}
+		if len(cards) != 1 || cards[0].DeckID != ankiDeckID {
+			t.Errorf("cards of %s = %v, want one in deck %d", bookmarkID, cards, ankiDeckID)
+		}
+	}
+}
+
+func TestExportAnkiUnknownColor(t *testing.T) {
+	if err := exportAnki(filepath.Join(t.TempDir(), "deck.apkg"), "purple", false); err == nil {
+		t.Errorf("exportAnki() with an unknown color succeeded, want an error")
+	}
+}
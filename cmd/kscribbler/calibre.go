@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// calibreSource imports highlights from Calibre viewer annotation exports (`calibre_annotation_collection` JSON).
+// path may be a single export or a directory of them; each file is one book.
+type calibreSource struct {
+	path string
+}
+
+func (source calibreSource) Name() string {
+	return "calibre"
+}
+
+// calibreExport is the JSON written by the Calibre viewer's "Export annotations" action.
+// Calibre does not record the book in the export, so title and isbn are optional additions; without them the
+// file name is used as the title and searched for an ISBN.
+type calibreExport struct {
+	Type        string `json:"type"`
+	Title       string `json:"title"`
+	ISBN        string `json:"isbn"`
+	Annotations []struct {
+		Type            string   `json:"type"`
+		UUID            string   `json:"uuid"`
+		HighlightedText string   `json:"highlighted_text"`
+		Notes           string   `json:"notes"`
+		Timestamp       string   `json:"timestamp"`
+		StartCFI        string   `json:"start_cfi"`
+		TocFamilyTitles []string `json:"toc_family_titles"`
+		Removed         bool     `json:"removed"`
+	} `json:"annotations"`
+}
+
+// Populate parses every export file and stores its highlights.
+func (source calibreSource) Populate() error {
+	info, err := os.Stat(source.path)
+	if err != nil {
+		return fmt.Errorf("calibre annotations %s are not readable: %w", source.path, err)
+	}
+
+	files := []string{source.path}
+	if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(source.path, "*.json"))
+		if err != nil {
+			return fmt.Errorf("failed to list calibre annotations in %s: %w", source.path, err)
+		}
+	}
+
+	var books []ImportedBook
+	for _, file := range files {
+		book, err := parseCalibreExport(file)
+		if err != nil {
+			slog.Warn("failed to parse calibre annotations", "file", file, "error", err)
+			continue
+		}
+		books = append(books, book)
+	}
+
+	insertImportedBooks(source.Name(), books)
+	return nil
+}
+
+// parseCalibreExport reads one export file into a book.
+func parseCalibreExport(file string) (ImportedBook, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return ImportedBook{}, err
+	}
+
+	var export calibreExport
+	if err := json.Unmarshal(raw, &export); err != nil {
+		return ImportedBook{}, err
+	}
+	if export.Type != "" && export.Type != "calibre_annotation_collection" {
+		return ImportedBook{}, fmt.Errorf("unexpected export type %q", export.Type)
+	}
+
+	stem := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	book := ImportedBook{
+		Title:  export.Title,
+		ISBN:   strings.ReplaceAll(export.ISBN, "-", ""),
+		Origin: file,
+	}
+	if book.Title == "" {
+		book.Title = stem
+	}
+	if book.ISBN == "" {
+		book.ISBN = strings.ReplaceAll(koreaderISBNRegex.FindString(stem), "-", "")
+	}
+
+	sum := sha1.Sum([]byte(book.Title))
+	book.BookID = "calibre:" + hex.EncodeToString(sum[:10])
+
+	for _, annotation := range export.Annotations {
+		text := strings.TrimSpace(annotation.HighlightedText)
+		if annotation.Type != "highlight" || annotation.Removed || text == "" {
+			continue
+		}
+
+		id := annotation.UUID
+		if id == "" {
+			idSum := sha1.Sum([]byte(book.BookID + "|" + annotation.StartCFI + "|" + text))
+			id = hex.EncodeToString(idSum[:])
+		}
+
+		highlight := ImportedHighlight{
+			BookmarkID: "calibre:" + id,
+			Text:       text,
+			Note:       strings.TrimSpace(annotation.Notes),
+			Datetime:   annotation.Timestamp,
+		}
+		if len(annotation.TocFamilyTitles) > 0 {
+			highlight.Chapter = annotation.TocFamilyTitles[len(annotation.TocFamilyTitles)-1]
+		}
+		book.Highlights = append(book.Highlights, highlight)
+	}
+
+	return book, nil
+}
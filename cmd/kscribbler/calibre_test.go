@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCalibreExport(t *testing.T) {
+	tests := []struct {
+		name         string
+		file         string
+		json         string
+		wantTitle    string
+		wantISBN     string
+		wantTexts    []string
+		wantNotes    []string
+		wantChapters []string
+	}{
+		{
+			name: "title and isbn keys",
+			file: "export.json",
+			json: `{
+				"type": "calibre_annotation_collection",
+				"title": "Some Book",
+				"isbn": "978-0-306-40615-7",
+				"annotations": [
+					{"type": "highlight", "uuid": "u1", "highlighted_text": " first ", "notes": " a note ",
+					 "timestamp": "2024-01-01T10:00:00Z", "toc_family_titles": ["Part One", "Chapter 2"]},
+					{"type": "highlight", "uuid": "u2", "highlighted_text": "second"}
+				]
+			}`,
+			wantTitle:    "Some Book",
+			wantISBN:     "9780306406157",
+			wantTexts:    []string{"first", "second"},
+			wantNotes:    []string{"a note", ""},
+			wantChapters: []string{"Chapter 2", ""},
+		},
+		{
+			name: "file name as title and isbn",
+			file: "Other Book 978-0-306-40615-7.json",
+			json: `{
+				"annotations": [
+					{"type": "bookmark", "uuid": "b1", "title": "a bookmark"},
+					{"type": "highlight", "uuid": "r1", "highlighted_text": "removed", "removed": true},
+					{"type": "highlight", "uuid": "e1", "highlighted_text": "   "},
+					{"type": "highlight", "start_cfi": "/2/4/2:10", "highlighted_text": "kept"}
+				]
+			}`,
+			wantTitle:    "Other Book 978-0-306-40615-7",
+			wantISBN:     "9780306406157",
+			wantTexts:    []string{"kept"},
+			wantNotes:    []string{""},
+			wantChapters: []string{""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(file, []byte(tt.json), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			book, err := parseCalibreExport(file)
+			if err != nil {
+				t.Fatalf("parseCalibreExport() error = %v", err)
+			}
+			if book.Title != tt.wantTitle || book.ISBN != tt.wantISBN || book.Origin != file {
+				t.Errorf("book = %q %q %q, want %q %q %q",
+					book.Title, book.ISBN, book.Origin, tt.wantTitle, tt.wantISBN, file)
+			}
+			if !strings.HasPrefix(book.BookID, "calibre:") {
+				t.Errorf("book id %q does not start with calibre:", book.BookID)
+			}
+
+			var texts, notes, chapters []string
+			for _, h := range book.Highlights {
+				texts = append(texts, h.Text)
+				notes = append(notes, h.Note)
+				chapters = append(chapters, h.Chapter)
+				if !strings.HasPrefix(h.BookmarkID, "calibre:") {
+					t.Errorf("bookmark id %q does not start with calibre:", h.BookmarkID)
+				}
+			}
+			if !reflect.DeepEqual(texts, tt.wantTexts) || !reflect.DeepEqual(notes, tt.wantNotes) ||
+				!reflect.DeepEqual(chapters, tt.wantChapters) {
+				t.Errorf("highlights = %q %q %q, want %q %q %q",
+					texts, notes, chapters, tt.wantTexts, tt.wantNotes, tt.wantChapters)
+			}
+		})
+	}
+}
+
+func TestParseCalibreExportIDs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, json string) ImportedBook {
+		t.Helper()
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(json), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		book, err := parseCalibreExport(file)
+		if err != nil {
+			t.Fatalf("parseCalibreExport(%s) error = %v", name, err)
+		}
+		return book
+	}
+
+	export := `{"title": "Same Book", "annotations": [
+		{"type": "highlight", "uuid": "abc", "highlighted_text": "one"},
+		{"type": "highlight", "start_cfi": "/2/4:1", "highlighted_text": "two"}
+	]}`
+	first := write("first.json", export)
+	second := write("second.json", export)
+
+	if first.BookID != second.BookID {
+		t.Errorf("book ids differ for the same title: %q and %q", first.BookID, second.BookID)
+	}
+	if got := first.Highlights[0].BookmarkID; got != "calibre:abc" {
+		t.Errorf("bookmark id = %q, want calibre:abc", got)
+	}
+	if first.Highlights[1].BookmarkID != second.Highlights[1].BookmarkID {
+		t.Errorf("bookmark ids without uuid are not stable: %q and %q",
+			first.Highlights[1].BookmarkID, second.Highlights[1].BookmarkID)
+	}
+}
+
+func TestParseCalibreExportErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"wrong type", `{"type": "calibre_bookmark_collection", "annotations": []}`},
+		{"invalid json", `{"annotations": [`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "export.json")
+			if err := os.WriteFile(file, []byte(tt.json), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := parseCalibreExport(file); err == nil {
+				t.Errorf("parseCalibreExport() succeeded, want an error")
+			}
+		})
+	}
+
+	if _, err := parseCalibreExport(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("parseCalibreExport() of a missing file succeeded, want an error")
+	}
+}
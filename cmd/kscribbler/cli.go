@@ -0,0 +1,669 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/GianniBYoung/kscribbler/version"
+)
+
+// command is a kscribbler subcommand.
+type command struct {
+	name    string
+	args    string
+	summary string
+	// setup registers the command's flags and returns the function to run once they are parsed.
+	setup func(fs *flag.FlagSet) func(args []string) error
+}
+
+var errUsage = errors.New("invalid usage")
+
+// commands lists the subcommands in the order they are shown by `kscribbler help`.
+var commands = []command{
+	{
+		name:    "sync",
+		summary: "Import highlights, match books on Hardcover and upload pending quotes (default)",
+		setup:   setupSync,
+	},
+	{
+		name:    "init",
+		summary: "Import highlights and match books on Hardcover without uploading anything",
+		setup:   setupInit,
+	},
+	{
+		name:    "retry",
+		summary: "Retry quotes whose upload failed now instead of waiting for their backoff",
+		setup:   setupRetry,
+	},
+	{
+		name:    "status",
+		summary: "Show a summary of the kscribbler database",
+		setup:   setupStatus,
+	},
+	{
+		name:    "books",
+		args:    "[include|exclude|ask|reset <book-id>]",
+		summary: "List books in the kscribbler database or change whether a book is synced",
+		setup:   setupBooks,
+	},
+	{
+		name:    "unmatched",
+		args:    "[resolve <book-id> <isbn> | resolve <book-id> <hardcover-id> <edition-id>]",
+		summary: "List books with pending quotes and no Hardcover match, or match them by hand",
+		setup:   setupUnmatched,
+	},
+	{
+		name:    "quotes",
+		summary: "List quotes in the kscribbler database",
+		setup:   setupQuotes,
+	},
+	{
+		name:    "history",
+		summary: "Show recent syncs, or the uploads of a run or quote",
+		setup:   setupHistory,
+	},
+	{
+		name:    "mark",
+		args:    "[bookmark-id...]",
+		summary: "Mark quotes as uploaded (or pending) without uploading them",
+		setup:   setupMark,
+	},
+	{
+		name:    "export",
+		args:    "<output-path>",
+		summary: "Export highlights to a file",
+		setup:   setupExport,
+	},
+	{
+		name:    "doctor",
+		summary: "Check the configuration, databases and Hardcover connection",
+		setup:   setupDoctor,
+	},
+	{
+		name:    "version",
+		summary: "Show version information",
+		setup:   setupVersion,
+	},
+}
+
+// legacyFlags maps the flags used before subcommands existed so old NickelMenu entries keep working.
+var legacyFlags = map[string][]string{
+	"--init":                 {"init"},
+	"-init":                  {"init"},
+	"--mark-all-as-uploaded": {"mark", "--all"},
+	"-mark-all-as-uploaded":  {"mark", "--all"},
+	"--version":              {"version"},
+	"-version":               {"version"},
+}
+
+// runCommand dispatches args to a subcommand and returns the process exit code.
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		args = []string{"sync"}
+	}
+	if legacy, ok := legacyFlags[args[0]]; ok {
+		args = append(legacy, args[1:]...)
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		if len(args) > 1 {
+			return runCommand([]string{args[1], "--help"})
+		}
+		printUsage(os.Stdout)
+		return 0
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+
+		fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+		fs.Usage = func() {
+			out := fs.Output()
+			fmt.Fprintf(out, "Usage: kscribbler %s [flags] %s\n\n%s\n", cmd.name, cmd.args, cmd.summary)
+			fmt.Fprintln(out, "\nFlags:")
+			fs.PrintDefaults()
+		}
+		run := cmd.setup(fs)
+
+		if err := fs.Parse(args[1:]); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return 0
+			}
+			return 2
+		}
+
+		if err := run(fs.Args()); err != nil {
+			if errors.Is(err, errUsage) {
+				fs.Usage()
+				return 2
+			}
+			slog.Error("command failed", "command", cmd.name, "error", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "kscribbler: unknown command %q\n\n", args[0])
+	printUsage(os.Stderr)
+	return 2
+}
+
+// printUsage lists the available subcommands.
+func printUsage(out *os.File) {
+	fmt.Fprintln(out, "Usage: kscribbler <command> [flags]")
+	fmt.Fprintln(out, "\nCommands:")
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	w.Flush()
+	fmt.Fprintln(out, "\nRun `kscribbler help <command>` for the flags of a command.")
+}
+
+func setupSync(fs *flag.FlagSet) func(args []string) error {
+	dryRun := fs.Bool(
+		"dry-run",
+		false,
+		"Match books and print every journal entry that would be posted without uploading or marking anything",
+	)
+
+	current := fs.Bool("current", false, "Only sync the book most recently opened in Nickel")
+	book := fs.String("book", "", "Only sync the book with this id (see kscribbler books)")
+
+	return func(args []string) error {
+		if len(args) > 0 || (*current && *book != "") {
+			return errUsage
+		}
+		if err := loadConfiguredTemplates(); err != nil {
+			return err
+		}
+		logStart()
+
+		bookID := *book
+		if *current {
+			var err error
+			bookID, err = currentKoboBookID()
+			if err != nil {
+				return err
+			}
+			slog.Info("Only syncing the current book", "book", bookID)
+		}
+
+		ctx, cancel := newRunContext()
+		defer cancel()
+
+		command := "sync"
+		if *dryRun {
+			command = "sync --dry-run"
+		}
+		run := newSyncRun(command)
+
+		err := prepareDatabase(ctx, bookID)
+		run.begin()
+		if err != nil {
+			run.finish(SyncSummary{}, err)
+			notify("Sync failed: " + err.Error())
+			return err
+		}
+		if *dryRun {
+			printPendingQuotes(bookID)
+			if syncProgress {
+				err = printReadingProgress(bookID)
+			}
+			run.finish(SyncSummary{}, err)
+			return err
+		}
+
+		summary := uploadPendingQuotes(ctx, bookID)
+		var progressErr error
+		if syncProgress && ctx.Err() == nil {
+			summary.Progress, progressErr = syncReadingProgress(ctx, bookID)
+			if progressErr != nil {
+				slog.Error("failed to sync reading progress", "error", progressErr)
+			} else {
+				slog.Info("Reading progress synced", "books", summary.Progress)
+			}
+		}
+		err = errors.Join(syncResult(summary), progressErr)
+		run.finish(summary, err)
+		notify(summary.Notification())
+		return err
+	}
+}
+
+func setupInit(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		logStart()
+		ctx, cancel := newRunContext()
+		defer cancel()
+
+		if err := prepareDatabase(ctx, ""); err != nil {
+			return err
+		}
+		fmt.Println("Database initialized. Quotes were not uploaded.")
+		return nil
+	}
+}
+
+func setupRetry(fs *flag.FlagSet) func(args []string) error {
+	failed := fs.Bool("failed", false, "Also retry quotes that ran out of attempts")
+
+	return func(args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		if err := loadConfiguredTemplates(); err != nil {
+			return err
+		}
+		logStart()
+		ctx, cancel := newRunContext()
+		defer cancel()
+
+		run := newSyncRun("retry")
+
+		err := prepareDatabase(ctx, "")
+		run.begin()
+		if err != nil {
+			run.finish(SyncSummary{}, err)
+			notify("Retry failed: " + err.Error())
+			return err
+		}
+
+		kscribblerDB = connectKscribblerDB()
+		count := resetRetries(*failed)
+		kscribblerDB.Close()
+		slog.Info("Retrying previously failed uploads", "bookmarks", count)
+
+		summary := uploadPendingQuotes(ctx, "")
+		err = syncResult(summary)
+		run.finish(summary, err)
+		notify(summary.Notification())
+		return err
+	}
+}
+
+func setupStatus(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		if err := openExistingKscribblerDB(); err != nil {
+			return err
+		}
+		defer kscribblerDB.Close()
+
+		status := loadLibraryStatus()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "Database:\t%s\n", kscribblerDBPath)
+		fmt.Fprintf(w, "Books:\t%d\n", status.Books)
+		fmt.Fprintf(w, "Books matched on Hardcover:\t%d\n", status.MatchedBooks)
+		fmt.Fprintf(w, "Quotes:\t%d\n", status.Quotes)
+		fmt.Fprintf(w, "Quotes uploaded:\t%d\n", status.UploadedQuotes)
+		fmt.Fprintf(w, "Quotes pending:\t%d\n", status.PendingQuotes)
+		fmt.Fprintf(w, "Quotes waiting to retry:\t%d\n", status.RetryingQuotes)
+		fmt.Fprintf(w, "Quotes failed (see kscribbler retry --failed):\t%d\n", status.FailedQuotes)
+		return w.Flush()
+	}
+}
+
+func setupBooks(fs *flag.FlagSet) func(args []string) error {
+	pendingOnly := fs.Bool("pending", false, "Only list books with quotes waiting to be uploaded")
+	editions := fs.Bool("editions", false, "Show why each book's Hardcover edition was chosen")
+
+	// book policies that can be set from the command line
+	policies := map[string]string{
+		"include": syncPolicyAlways,
+		"exclude": syncPolicyNever,
+		"ask":     syncPolicyAsk,
+		"reset":   "",
+	}
+
+	return func(args []string) error {
+		if len(args) > 0 {
+			policy, ok := policies[args[0]]
+			if !ok || len(args) != 2 {
+				return errUsage
+			}
+			if err := openExistingKscribblerDB(); err != nil {
+				return err
+			}
+			defer kscribblerDB.Close()
+
+			if err := setSyncPolicy(args[1], policy); err != nil {
+				return err
+			}
+			fmt.Printf("Sync policy of %s updated.\n", args[1])
+			return nil
+		}
+
+		if err := openExistingKscribblerDB(); err != nil {
+			return err
+		}
+		defer kscribblerDB.Close()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		header := "BOOK ID\tTITLE\tISBN\tMATCH\tHARDCOVER ID\tEDITION\tPENDING\tSOURCE\tSYNC"
+		if *editions {
+			header += "\tEDITION CHOICE"
+		}
+		fmt.Fprintln(w, header)
+		for _, book := range listBooks(*pendingOnly) {
+			policy, _ := book.syncPolicy()
+			row := fmt.Sprintf(
+				"%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s",
+				book.BookID,
+				truncate(book.Title.String, 40),
+				book.FoundISBN.String,
+				book.MatchState,
+				book.HardcoverID,
+				book.HardcoverEdition,
+				book.PendingQuotes,
+				book.Source,
+				policy,
+			)
+			if *editions {
+				row += "\t" + book.EditionReason.String
+			}
+			fmt.Fprintln(w, row)
+		}
+		return w.Flush()
+	}
+}
+
+func setupUnmatched(fs *flag.FlagSet) func(args []string) error {
+	interactive := fs.Bool("interactive", false, "Ask for an ISBN or Hardcover ids for each unmatched book")
+
+	return func(args []string) error {
+		if *interactive && len(args) > 0 {
+			return errUsage
+		}
+		if err := openExistingKscribblerDB(); err != nil {
+			return err
+		}
+		defer kscribblerDB.Close()
+
+		if *interactive || len(args) > 0 {
+			var lookups []string
+			if *interactive {
+				var err error
+				if lookups, err = promptUnmatchedBooks(os.Stdin, os.Stdout); err != nil {
+					return err
+				}
+			} else {
+				if args[0] != "resolve" || len(args) < 3 {
+					return errUsage
+				}
+				needsLookup, err := resolveBook(args[1], args[2:])
+				if err != nil {
+					return err
+				}
+				if needsLookup {
+					lookups = append(lookups, args[1])
+				}
+				fmt.Printf("Book %s updated.\n", args[1])
+			}
+
+			ctx, cancel := newRunContext()
+			defer cancel()
+			lookUpResolvedBooks(ctx, lookups)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "BOOK ID\tTITLE\tISBN\tPENDING\tSOURCE\tREASON")
+		for _, book := range listUnmatchedBooks("") {
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%s\t%d\t%s\t%s\n",
+				book.BookID,
+				truncate(book.Title.String, 40),
+				book.FoundISBN.String,
+				book.PendingQuotes,
+				book.Source,
+				book.unmatchedReason(),
+			)
+		}
+		return w.Flush()
+	}
+}
+
+func setupQuotes(fs *flag.FlagSet) func(args []string) error {
+	bookID := fs.String("book", "", "Only list quotes of the book with this id")
+	pendingOnly := fs.Bool("pending", false, "Only list quotes waiting to be uploaded")
+	failedOnly := fs.Bool("failed", false, "Only list quotes whose upload failed, with the error")
+	limit := fs.Int("limit", 50, "Maximum number of quotes to list (0 for no limit)")
+
+	return func(args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		if err := openExistingKscribblerDB(); err != nil {
+			return err
+		}
+		defer kscribblerDB.Close()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "BOOKMARK ID\tTYPE\tPAGE\tUPLOADED\tATTEMPTS\tQUOTE\tLAST ERROR")
+		for _, bm := range listQuotes(*bookID, *pendingOnly, *failedOnly, *limit) {
+			page := ""
+			if bm.Page.Valid {
+				page = fmt.Sprint(bm.Page.Int64)
+			}
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%s\t%t\t%d\t%s\t%s\n",
+				bm.BookmarkID,
+				bm.Type,
+				page,
+				bm.KscribblerUploaded,
+				bm.Attempts,
+				truncate(bm.Quote.String, 60),
+				truncate(bm.LastError.String, 60),
+			)
+		}
+		return w.Flush()
+	}
+}
+
+func setupHistory(fs *flag.FlagSet) func(args []string) error {
+	limit := fs.Int("limit", 20, "Maximum number of runs to list, 0 for all")
+	runID := fs.Int64("run", 0, "List the uploads of the run with this id")
+	bookmarkID := fs.String("quote", "", "List every upload attempt of the quote with this bookmark id")
+
+	return func(args []string) error {
+		if len(args) > 0 || (*runID != 0 && *bookmarkID != "") {
+			return errUsage
+		}
+		if err := openExistingKscribblerDB(); err != nil {
+			return err
+		}
+		defer kscribblerDB.Close()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		if *runID != 0 || *bookmarkID != "" {
+			fmt.Fprintln(w, "RUN\tTIME\tVERSION\tBOOKMARK ID\tBOOK ID\tHARDCOVER ID\tEDITION\tRESULT")
+			for _, event := range listUploadEvents(*runID, *bookmarkID) {
+				result := "uploaded"
+				if !event.Uploaded {
+					result = "failed: " + truncate(event.Error.String, 60)
+				}
+				fmt.Fprintf(
+					w,
+					"%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+					nullInt(event.RunID),
+					formatUnix(event.CreatedAt),
+					event.Version.String,
+					event.BookmarkID,
+					event.BookID,
+					event.HardcoverID.Int64,
+					event.HardcoverEdition.Int64,
+					result,
+				)
+			}
+			return w.Flush()
+		}
+
+		fmt.Fprintln(w, "RUN\tSTARTED\tDURATION\tVERSION\tCOMMAND\tNEW BOOKS\tNEW QUOTES\tUPLOADED\tFAILED\tUNMATCHED\tRESULT")
+		for _, run := range listSyncRuns(*limit) {
+			duration := "-"
+			result := "running"
+			if run.FinishedAt.Valid {
+				duration = (time.Duration(run.FinishedAt.Int64-run.StartedAt) * time.Second).String()
+				result = "ok"
+			}
+			if run.Error.Valid {
+				result = truncate(run.Error.String, 60)
+			}
+			fmt.Fprintf(
+				w,
+				"%d\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n",
+				run.RunID,
+				formatUnix(run.StartedAt),
+				duration,
+				run.Version,
+				run.Command,
+				run.NewBooks,
+				run.NewQuotes,
+				run.Uploaded,
+				run.Failed,
+				run.Unmatched,
+				result,
+			)
+		}
+		return w.Flush()
+	}
+}
+
+func setupMark(fs *flag.FlagSet) func(args []string) error {
+	all := fs.Bool("all", false, "Mark every quote, dogear and markup in the database (useful for migration)")
+	bookID := fs.String("book", "", "Mark every quote, dogear and markup of the book with this id")
+	pending := fs.Bool("pending", false, "Mark the quotes as pending so they are uploaded again")
+
+	return func(args []string) error {
+		if !*all && *bookID == "" && len(args) == 0 {
+			return errUsage
+		}
+
+		logStart()
+		populateDatabase()
+		kscribblerDB = connectKscribblerDB()
+		defer kscribblerDB.Close()
+
+		quotes, markers := markQuotes(*all, *bookID, args, !*pending)
+		state := "uploaded"
+		if *pending {
+			state = "pending"
+		}
+		fmt.Printf("Marked %d quotes and %d dogears and markups as %s. Nothing was uploaded.\n", quotes, markers, state)
+		return nil
+	}
+}
+
+func setupExport(fs *flag.FlagSet) func(args []string) error {
+	format := fs.String("format", "anki", "Export format (anki, markdown)")
+	color := fs.String(
+		"color",
+		"",
+		"anki: also export highlights of this color (yellow, pink, blue, green) besides kscrib:anki notes",
+	)
+	vocabulary := fs.Bool("vocabulary", true, "anki: also export words looked up in the Kobo dictionary")
+
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+
+		if *format != "anki" && *format != "markdown" {
+			return fmt.Errorf("unknown export format %q", *format)
+		}
+
+		logStart()
+		populateDatabase()
+		kscribblerDB = connectKscribblerDB()
+		defer kscribblerDB.Close()
+		if *format == "markdown" {
+			exportMarkdown(args[0])
+			return nil
+		}
+		return exportAnki(args[0], *color, *vocabulary)
+	}
+}
+
+func setupDoctor(fs *flag.FlagSet) func(args []string) error {
+	offline := fs.Bool("offline", false, "Skip the Hardcover connection and token checks")
+
+	return func(args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		if !runDoctor(*offline) {
+			return errors.New("some checks failed")
+		}
+		return nil
+	}
+}
+
+func setupVersion(fs *flag.FlagSet) func(args []string) error {
+	verbose := fs.Bool("verbose", false, "Also show the commit and build date")
+
+	return func(args []string) error {
+		if len(args) > 0 {
+			return errUsage
+		}
+		// upgrade.sh relies on the bare "vX.Y.Z" output
+		fmt.Printf("v%s", version.Version)
+		if *verbose {
+			fmt.Printf(" (commit %s, built %s)\n", version.Commit, version.Date)
+		}
+		return nil
+	}
+}
+
+// syncResult turns a sync that was cut short into a command error so the exit status reflects it.
+func syncResult(summary SyncSummary) error {
+	if summary.Interrupted != "" {
+		return fmt.Errorf("sync stopped early: %s", summary.Interrupted)
+	}
+	return nil
+}
+
+// logStart logs the version at the start of commands that write to kscribbler.log.
+func logStart() {
+	slog.Info("Starting Kscribbler", "version", version.Version)
+}
+
+// formatUnix formats a unix timestamp stored in kscribblerDB in local time.
+func formatUnix(seconds int64) string {
+	return time.Unix(seconds, 0).Format("2006-01-02 15:04:05")
+}
+
+// nullInt formats an optional id for table output.
+func nullInt(n sql.NullInt64) string {
+	if !n.Valid {
+		return "-"
+	}
+	return strconv.FormatInt(n.Int64, 10)
+}
+
+// truncate shortens s to at most n runes for table output.
+func truncate(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
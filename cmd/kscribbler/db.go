@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/GianniBYoung/simpleISBN"
 
@@ -16,37 +21,62 @@ var kscribblerDB *sqlx.DB
 var koboDBPath = "/mnt/onboard/.kobo/KoboReader.sqlite"
 var kscribblerDBPath = "/mnt/onboard/.adds/kscribbler/kscribbler.sqlite"
 
+// Values of book.match_state, the only record of whether a book is matched. hardcover_id and hardcover_edition
+// keep their -1 default, or are reset to it, while a book is not matched and are only read once it is.
+const (
+	// not looked up yet, or the lookup failed and is tried again on the next sync
+	matchStateUnresolved = "unresolved"
+	// Hardcover has no edition with the book's ISBN, looked up again after notFoundRecheckInterval
+	matchStateNotFound = "not_found"
+	matchStateMatched  = "matched"
+)
+
+// Books Hardcover does not have are looked up again once notFoundRecheckInterval has passed since the last
+// lookup, in case the edition was added since.
+const notFoundRecheckInterval = 7 * 24 * time.Hour
+
 // connectKscribblerDB connects to the kscribbler SQLite database and creates it if it doesn't exist.
 func connectKscribblerDB() *sqlx.DB {
-	dbErrMsg := "failed to open database at %s: %w"
-
 	kscribblerDB, err := sqlx.Open("sqlite", kscribblerDBPath)
 	if err != nil {
-		err := fmt.Errorf(dbErrMsg, kscribblerDBPath, err)
-		log.Fatal(err.Error())
+		fatal("failed to open database", "path", kscribblerDBPath, "error", err)
 	}
 	return kscribblerDB
 }
 
+// openExistingKscribblerDB connects to kscribblerDB for read-only commands, which should not create it.
+func openExistingKscribblerDB() error {
+	if _, err := os.Stat(kscribblerDBPath); err != nil {
+		return fmt.Errorf("no kscribbler database at %s, run `kscribbler init` first: %w", kscribblerDBPath, err)
+	}
+	migrateKscribblerTables()
+	kscribblerDB = connectKscribblerDB()
+	return nil
+}
+
 // connectDatabases attaches kscribblerDB to KoboReaderDB in order to populate kscribblerDB with relevant data.
 func connectDatabases() *sqlx.DB {
 	kscribblerDB := connectKscribblerDB()
 	// attach to kobo database also
-	_, err := kscribblerDB.Exec("ATTACH DATABASE ? AS koboDB", koboDBPath)
-	if err != nil {
-		err := fmt.Errorf("failed to attach Kobo database: %w", err)
-		log.Fatal(err.Error())
+	if err := attachKoboDB(kscribblerDB); err != nil {
+		fatal("failed to attach Kobo database", "path", koboDBPath, "error", err)
 	}
 	return kscribblerDB
 }
 
+// attachKoboDB attaches KoboReader.sqlite to db as koboDB.
+func attachKoboDB(db *sqlx.DB) error {
+	_, err := db.Exec("ATTACH DATABASE ? AS koboDB", koboDBPath)
+	return err
+}
+
 // createKscribblerTables creates the SQLite database if it doesn't exist.
 func createKscribblerTables() {
 	if _, err := os.Stat(kscribblerDBPath); err == nil {
-		log.Printf("kscribblerDB already exists at %s, skipping creation", kscribblerDBPath)
+		slog.Debug("kscribblerDB already exists, skipping creation", "path", kscribblerDBPath)
 		return
 	} else if !errors.Is(err, os.ErrNotExist) {
-		log.Fatalf("Error while trying to create/open kscribblerDB: %v", err)
+		fatal("failed to create or open kscribblerDB", "error", err)
 	}
 
 	kscribblerDB := connectKscribblerDB()
@@ -62,7 +92,7 @@ func createKscribblerTables() {
     )
 `)
 	if err != nil {
-		log.Fatalf("failed to create book table in kscribblerDB: %v", err)
+		fatal("failed to create book table in kscribblerDB", "error", err)
 	}
 
 	// Quotes table
@@ -80,87 +110,277 @@ func createKscribblerTables() {
     )
 `)
 	if err != nil {
-		log.Fatalf("failed to create quotes table in kscribblerDB: %v", err)
+		fatal("failed to create quote table in kscribblerDB", "error", err)
 	}
 
 }
 
+// migrateKscribblerTables adds columns introduced after the initial schema to an existing kscribblerDB.
+func migrateKscribblerTables() {
+	kscribblerDB := connectKscribblerDB()
+	defer kscribblerDB.Close()
+
+	addColumnIfMissing(kscribblerDB, "quote", "color", "INTEGER")
+	addColumnIfMissing(kscribblerDB, "book", "source", "TEXT NOT NULL DEFAULT 'nickel'")
+	addColumnIfMissing(kscribblerDB, "quote", "source", "TEXT NOT NULL DEFAULT 'nickel'")
+	addColumnIfMissing(kscribblerDB, "book", "sync_policy", "TEXT")
+	addColumnIfMissing(kscribblerDB, "quote", "attempts", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing(kscribblerDB, "quote", "last_error", "TEXT")
+	addColumnIfMissing(kscribblerDB, "quote", "next_attempt_at", "INTEGER")
+	addColumnIfMissing(kscribblerDB, "book", "match_error", "TEXT")
+	addColumnIfMissing(kscribblerDB, "book", "language", "TEXT")
+	addColumnIfMissing(kscribblerDB, "book", "edition_reason", "TEXT")
+	addColumnIfMissing(kscribblerDB, "book", "hardcover_pages", "INTEGER")
+	addColumnIfMissing(kscribblerDB, "quote", "position", "REAL")
+	addColumnIfMissing(kscribblerDB, "quote", "chapter", "TEXT")
+	addColumnIfMissing(kscribblerDB, "quote", "created_at", "TEXT")
+	addColumnIfMissing(kscribblerDB, "quote", "raw_quote", "TEXT")
+	addColumnIfMissing(kscribblerDB, "quote", "content_id", "TEXT")
+	addColumnIfMissing(kscribblerDB, "quote", "start_path", "TEXT")
+	addColumnIfMissing(kscribblerDB, "quote", "start_offset", "INTEGER")
+	addColumnIfMissing(kscribblerDB, "quote", "end_path", "TEXT")
+	addColumnIfMissing(kscribblerDB, "quote", "end_offset", "INTEGER")
+	addColumnIfMissing(kscribblerDB, "quote", "uploaded_parts", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing(kscribblerDB, "book", "synced_progress", "TEXT")
+	addColumnIfMissing(kscribblerDB, "book", "match_checked_at", "INTEGER")
+	if addColumnIfMissing(kscribblerDB, "book", "match_state", "TEXT NOT NULL DEFAULT '"+matchStateUnresolved+"'") {
+		migrateMatchState(kscribblerDB)
+	}
+	createHistoryTables(kscribblerDB)
+	createMarkerTable(kscribblerDB)
+	addColumnIfMissing(kscribblerDB, "marker", "attempts", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing(kscribblerDB, "marker", "last_error", "TEXT")
+	addColumnIfMissing(kscribblerDB, "marker", "next_attempt_at", "INTEGER")
+}
+
+// columnExists reports whether table in the given schema (main, koboDB, ...) has the named column.
+func columnExists(db *sqlx.DB, schema string, table string, column string) bool {
+	var count int
+	err := db.Get(
+		&count,
+		`SELECT COUNT(*) FROM pragma_table_info(?, ?) WHERE name = ?;`,
+		table,
+		schema,
+		column,
+	)
+	if err != nil {
+		slog.Error("failed to inspect table", "table", schema+"."+table, "error", err)
+		return false
+	}
+	return count > 0
+}
+
+// addColumnIfMissing alters table to add column with the given definition when it does not exist yet.
+// It reports whether the column was added so callers can backfill it.
+func addColumnIfMissing(db *sqlx.DB, table string, column string, definition string) bool {
+	if columnExists(db, "main", table, column) {
+		return false
+	}
+
+	slog.Info("Migrating kscribblerDB: adding column", "table", table, "column", column)
+	_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, table, column, definition))
+	if err != nil {
+		fatal("failed to add column", "table", table, "column", column, "error", err)
+	}
+	return true
+}
+
+// migrateMatchState derives match_state from the -1 (or 0) hardcover ids that used to mean "not matched".
+func migrateMatchState(db *sqlx.DB) {
+	result, err := db.Exec(
+		`UPDATE book SET match_state = ? WHERE hardcover_id > 0 AND hardcover_edition > 0;`,
+		matchStateMatched,
+	)
+	if err != nil {
+		fatal("failed to migrate book match state", "error", err)
+	}
+	matched, _ := result.RowsAffected()
+	slog.Info("Migrated book match state", "matched_books", matched)
+}
+
 // populateQuoteTable populates the quote table in kscribblerDB with quotes and annotations from KoboReader.sqlite.
 func populateQuoteTable() {
 	kscribblerDB := connectDatabases()
 	defer kscribblerDB.Close()
 
 	quoteQuery := `
-		INSERT OR IGNORE INTO quote(book_id, bookmark_id, type, quote, annotation, page, kscribbler_uploaded)
-		SELECT b.VolumeID, b.BookmarkID, b.Type, TRIM(b.Text), b.Annotation,
-		CASE
-			WHEN sp.StorePages > 0 AND ts.total_sections > 0 THEN
-				CAST(ROUND((COALESCE(c.VolumeIndex, 0) + b.ChapterProgress) * 1.0 / ts.total_sections * sp.StorePages) AS INTEGER)
-			ELSE NULL
-		END,
+		INSERT OR IGNORE INTO quote(book_id, bookmark_id, type, quote, annotation, chapter, created_at, kscribbler_uploaded)
+		SELECT b.VolumeID, b.BookmarkID, b.Type, TRIM(b.Text), b.Annotation, c.Title, b.DateCreated,
 		CASE
 			WHEN instr(lower(b.Annotation), 'kscrib') > 0 THEN 1
 			ELSE 0
 		END
 		FROM koboDB.Bookmark b
 		JOIN koboDB.content c ON b.ContentID = c.ContentID
-		LEFT JOIN (
-			SELECT ContentID, StorePages FROM koboDB.content WHERE StorePages > 0
-		) sp ON sp.ContentID = b.VolumeID
-		LEFT JOIN (
-			SELECT BookID, COUNT(*) as total_sections
-			FROM koboDB.content WHERE ContentType = 9 GROUP BY BookID
-		) ts ON ts.BookID = b.VolumeID
 		WHERE b.Text IS NOT NULL AND TRIM(b.Text) != ''
    `
-	log.Printf("Populating quote table...")
+	slog.Info("Populating quote table")
 	_, err := kscribblerDB.Exec(quoteQuery)
 	if err != nil {
-		log.Fatalf("failed to populate kscribblerDB book Table: %v", err)
+		fatal("failed to populate quote table", "error", err)
 	}
 
+	// pages are derived from the position, so positions go first
+	syncPositions(kscribblerDB)
 	syncPageNumbers(kscribblerDB)
+	syncHighlightColors(kscribblerDB)
+	syncQuoteDetails(kscribblerDB)
+	syncHighlightRanges(kscribblerDB)
+}
+
+// syncQuoteDetails backfills the chapter and creation date of quotes imported before they were recorded.
+func syncQuoteDetails(kscribblerDB *sqlx.DB) {
+	_, err := kscribblerDB.Exec(`
+		UPDATE quote
+		SET
+			chapter = COALESCE(quote.chapter, (
+				SELECT c.Title FROM koboDB.Bookmark b
+				JOIN koboDB.content c ON b.ContentID = c.ContentID
+				WHERE b.BookmarkID = quote.bookmark_id
+			)),
+			created_at = COALESCE(quote.created_at, (
+				SELECT b.DateCreated FROM koboDB.Bookmark b WHERE b.BookmarkID = quote.bookmark_id
+			))
+		WHERE quote.source = 'nickel'
+		AND (quote.chapter IS NULL OR quote.created_at IS NULL);
+	`)
+	if err != nil {
+		slog.Error("failed to sync quote chapters and dates", "error", err)
+	}
 }
 
-// syncPageNumbers backfills page numbers for existing quotes that are missing them.
+// syncHighlightColors copies the highlight color from KoboReader.sqlite for firmware that records one.
+func syncHighlightColors(kscribblerDB *sqlx.DB) {
+	if !columnExists(kscribblerDB, "koboDB", "Bookmark", "Color") {
+		return
+	}
+
+	_, err := kscribblerDB.Exec(`
+		UPDATE quote
+		SET color = (
+			SELECT b.Color FROM koboDB.Bookmark b WHERE b.BookmarkID = quote.bookmark_id
+		)
+		WHERE quote.color IS NULL;
+	`)
+	if err != nil {
+		slog.Error("failed to sync highlight colors", "error", err)
+	}
+}
+
+// syncPositions computes how far through the book (0 to 1) each Nickel quote is. Chapters (ContentType 9 rows)
+// are weighted by their ___FileSize so a long chapter counts for more than a short one; books without sizes treat
+// every chapter as the same length. Pending quotes are recomputed on every sync.
+func syncPositions(kscribblerDB *sqlx.DB) {
+	updateQuery := positionUpdateQuery(
+		kscribblerDB,
+		"quote",
+		"quote.source = 'nickel' AND (quote.position IS NULL OR quote.kscribbler_uploaded = 0)",
+	)
+	if _, err := kscribblerDB.Exec(updateQuery); err != nil {
+		slog.Error("failed to sync quote positions", "error", err)
+	}
+}
+
+// positionUpdateQuery builds the UPDATE that sets the position of the rows of table matching where from their
+// Kobo bookmark, as described on syncPositions.
+func positionUpdateQuery(kscribblerDB *sqlx.DB, table string, where string) string {
+	sizeColumn := "0"
+	if columnExists(kscribblerDB, "koboDB", "content", "___FileSize") {
+		sizeColumn = "COALESCE(___FileSize, 0)"
+	}
+
+	return `
+		WITH section AS (
+			SELECT BookID, VolumeIndex, MAX(` + sizeColumn + `) AS size
+			FROM koboDB.content
+			WHERE ContentType = 9
+			GROUP BY BookID, VolumeIndex
+		), book_size AS (
+			SELECT BookID, SUM(size) AS total_size, COUNT(*) AS total_sections
+			FROM section
+			GROUP BY BookID
+		)
+		UPDATE ` + table + `
+		SET position = (
+			SELECT MIN(1.0, MAX(0.0, CASE
+				WHEN bs.total_size > 0 THEN
+					(
+						COALESCE((
+							SELECT SUM(s.size) FROM section s
+							WHERE s.BookID = b.VolumeID AND s.VolumeIndex < c.VolumeIndex
+						), 0)
+						+ b.ChapterProgress * COALESCE(cs.size, 0)
+					) * 1.0 / bs.total_size
+				ELSE (COALESCE(c.VolumeIndex, 0) + b.ChapterProgress) * 1.0 / bs.total_sections
+			END))
+			FROM koboDB.Bookmark b
+			JOIN koboDB.content c ON b.ContentID = c.ContentID
+			JOIN book_size bs ON bs.BookID = b.VolumeID
+			LEFT JOIN section cs ON cs.BookID = b.VolumeID AND cs.VolumeIndex = c.VolumeIndex
+			WHERE b.BookmarkID = ` + table + `.bookmark_id
+			AND bs.total_sections > 0
+		)
+		WHERE ` + where + `;
+	`
+}
+
+// syncPageNumbers sets page numbers of the Kobo book from the quote's position and the book's StorePages, for quotes
+// without a page and for pending Nickel quotes whose position may have been recomputed.
 func syncPageNumbers(kscribblerDB *sqlx.DB) {
 	updateQuery := `
 		UPDATE quote
 		SET page = (
-			SELECT CAST(ROUND(
-				(COALESCE(c.VolumeIndex, 0) + b.ChapterProgress) * 1.0
-				/ ts.total_sections * sp.StorePages
-			) AS INTEGER)
-			FROM koboDB.Bookmark b
-			JOIN koboDB.content c ON b.ContentID = c.ContentID
-			JOIN (
-				SELECT ContentID, StorePages FROM koboDB.content WHERE StorePages > 0
-			) sp ON sp.ContentID = b.VolumeID
-			JOIN (
-				SELECT BookID, COUNT(*) as total_sections
-				FROM koboDB.content WHERE ContentType = 9 GROUP BY BookID
-			) ts ON ts.BookID = b.VolumeID
-			WHERE b.BookmarkID = quote.bookmark_id
+			SELECT CAST(ROUND(quote.position * sp.StorePages) AS INTEGER)
+			FROM koboDB.content sp
+			WHERE sp.ContentID = quote.book_id
+			AND sp.StorePages > 0
 		)
-		WHERE quote.page IS NULL
+		WHERE quote.position IS NOT NULL
+		AND (quote.page IS NULL OR (quote.source = 'nickel' AND quote.kscribbler_uploaded = 0))
 		AND EXISTS (
-			SELECT 1 FROM koboDB.Bookmark b
-			JOIN (SELECT ContentID, StorePages FROM koboDB.content WHERE StorePages > 0) sp
-			ON sp.ContentID = b.VolumeID
-			WHERE b.BookmarkID = quote.bookmark_id
+			SELECT 1 FROM koboDB.content sp
+			WHERE sp.ContentID = quote.book_id
+			AND sp.StorePages > 0
 		);
 	`
 
 	result, err := kscribblerDB.Exec(updateQuery)
 	if err != nil {
-		log.Printf("failed to sync page numbers: %v", err)
+		slog.Error("failed to sync page numbers", "error", err)
 		return
 	}
 
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected > 0 {
-		log.Printf("Backfilled page numbers for %d quotes", rowsAffected)
+		slog.Debug("Updated page numbers", "quotes", rowsAffected)
+	}
+}
+
+// currentKoboBookID returns the book most recently opened in Nickel, read from KoboReader.sqlite.
+func currentKoboBookID() (string, error) {
+	if _, err := os.Stat(koboDBPath); err != nil {
+		return "", fmt.Errorf("KoboReader.sqlite is not readable at %s: %w", koboDBPath, err)
+	}
+
+	koboDB, err := sqlx.Open("sqlite", "file:"+koboDBPath+"?mode=ro")
+	if err != nil {
+		return "", fmt.Errorf("failed to open KoboReader.sqlite: %w", err)
 	}
+	defer koboDB.Close()
+
+	var bookID string
+	err = koboDB.Get(&bookID, `
+		SELECT ContentID
+		FROM content
+		WHERE ContentType = 6
+		AND DateLastRead IS NOT NULL AND DateLastRead != ''
+		ORDER BY DateLastRead DESC
+		LIMIT 1;
+	`)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the last opened book: %w", err)
+	}
+	return bookID, nil
 }
 
 // populateBookTable populates the book table in kscribblerDB with book identifiers from KoboReader.sqlite.
@@ -175,10 +395,24 @@ func populateBookTable() {
 		JOIN koboDB.Bookmark b
 		ON c.ContentID = b.VolumeID
    `
-	log.Printf("Populating book table...")
+	slog.Info("Populating book table")
 	_, err := kscribblerDB.Exec(bookQuery)
 	if err != nil {
-		log.Fatalf("failed to populate kscribblerDB book Table : %v", err)
+		fatal("failed to populate book table", "error", err)
+	}
+
+	// the language is used to prefer editions in the same language on Hardcover
+	_, err = kscribblerDB.Exec(`
+		UPDATE book
+		SET language = (
+			SELECT c.Language FROM koboDB.content c
+			WHERE c.ContentID = book.book_id AND c.Language IS NOT NULL AND c.Language != ''
+			LIMIT 1
+		)
+		WHERE book.language IS NULL;
+	`)
+	if err != nil {
+		slog.Error("failed to sync book languages from KoboDB", "error", err)
 	}
 }
 
@@ -210,65 +444,168 @@ func syncISBNsFromKoboDB() {
 		);
 	`
 
-	log.Printf("Syncing ISBNs from KoboDB for existing books...")
+	slog.Info("Syncing ISBNs from KoboDB for existing books")
 	result, err := kscribblerDB.Exec(updateQuery)
 	if err != nil {
-		log.Printf("failed to sync ISBNs from KoboDB: %v", err)
+		slog.Error("failed to sync ISBNs from KoboDB", "error", err)
 		return
 	}
 
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected > 0 {
-		log.Printf("Updated %d books with ISBNs from KoboDB", rowsAffected)
+		slog.Info("Updated books with ISBNs from KoboDB", "books", rowsAffected)
 	}
 }
 
 // updateDBWithHardcoverInfo updates the kscribblerDB with missing hardcover info from Hardcover API.
-func updateDBWithHardcoverInfo() {
+// An empty bookID looks up every unresolved book and the not_found books due for a recheck, otherwise only that
+// book whatever its last lookup.
+func updateDBWithHardcoverInfo(ctx context.Context, bookID string) {
 
 	var books []Book
 	err := kscribblerDB.Select(
 		&books,
-		`SELECT isbn FROM book WHERE (hardcover_id = -1 OR hardcover_edition = -1) AND isbn IS NOT NULL;`,
+		`SELECT book_id, book_title, isbn, language FROM book
+		WHERE match_state != ? AND isbn IS NOT NULL
+		AND (? = '' OR book_id = ?)
+		AND (? != '' OR match_state != ? OR match_checked_at IS NULL OR match_checked_at <= ?);`,
+		matchStateMatched,
+		bookID,
+		bookID,
+		bookID,
+		matchStateNotFound,
+		time.Now().Add(-notFoundRecheckInterval).Unix(),
 	)
 
 	if err != nil {
-		log.Printf("failed to load books with missing hardcover info: %v", err)
+		slog.Error("failed to load books with missing hardcover info", "error", err)
 		return
 	}
 
-	log.Printf("Found %d books with missing hardcover info", len(books))
+	slog.Info("Found books with missing hardcover info", "books", len(books))
+	client := newHTTPClient()
 	for _, book := range books {
+		if ctx.Err() != nil {
+			slog.Warn("Stopping Hardcover lookups", "reason", interruptionReason(ctx))
+			return
+		}
+
 		isbn, err := simpleISBN.NewISBN(book.FoundISBN.String)
 		if err != nil {
-			log.Printf("failed to parse isbn %s: %v", book.FoundISBN.String, err)
+			slog.Warn("failed to parse isbn", "isbn", book.FoundISBN.String, "error", err)
+			setMatchState(book.BookID, matchStateUnresolved, fmt.Sprintf("ISBN %s could not be parsed: %v", book.FoundISBN.String, err))
 			continue
 		}
 		book.SimpleISBN = *isbn
 
-		book.koboToHardcover()
+		if err := book.koboToHardcover(ctx, client); err != nil {
+			// not_found books wait for notFoundRecheckInterval, failed lookups stay unresolved for the next sync
+			if errors.Is(err, errNotOnHardcover) {
+				setMatchState(book.BookID, matchStateNotFound, fmt.Sprintf("ISBN %s is not on Hardcover", book.FoundISBN.String))
+				continue
+			}
+			slog.Error("failed to look up book on Hardcover", "isbn", book.FoundISBN.String, "error", err)
+			setMatchState(book.BookID, matchStateUnresolved, fmt.Sprintf("Hardcover lookup failed: %v", err))
+			continue
+		}
 
-		log.Printf(
-			"Updating book %s with hardcover info: %d, %d, %s, %s",
-			book.Title.String,
-			book.HardcoverID,
-			book.HardcoverEdition,
-			book.SimpleISBN.ISBN13Number,
-			book.SimpleISBN.ISBN10Number,
+		slog.Info(
+			"Updating book with hardcover info",
+			"title", book.Title.String,
+			"hardcover_id", book.HardcoverID,
+			"edition", book.HardcoverEdition,
+			"isbn13", book.SimpleISBN.ISBN13Number,
+			"isbn10", book.SimpleISBN.ISBN10Number,
 		)
-		_, err = kscribblerDB.Exec(
-			`UPDATE book SET hardcover_id = ?, hardcover_edition = ? WHERE isbn = ? OR isbn = ?;`,
+		result, err := kscribblerDB.Exec(
+			`UPDATE book
+			SET hardcover_id = ?, hardcover_edition = ?, hardcover_pages = ?, edition_reason = ?, match_state = ?,
+				match_error = NULL, match_checked_at = strftime('%s', 'now')
+			WHERE book_id = ?;`,
 			book.HardcoverID,
 			book.HardcoverEdition,
-			book.SimpleISBN.ISBN13Number,
-			book.SimpleISBN.ISBN10Number,
+			book.HardcoverPages,
+			book.EditionReason,
+			matchStateMatched,
+			book.BookID,
 		)
 		if err != nil {
-			log.Printf("failed to update book %s with hardcover info: %v", book.Title.String, err)
+			slog.Error("failed to update book with hardcover info", "title", book.Title.String, "error", err)
+		} else if n, _ := result.RowsAffected(); n != 1 {
+			slog.Error("failed to update book with hardcover info", "title", book.Title.String, "book", book.BookID, "rows", n)
 		}
 	}
+	backfillEditionPages(ctx, client, bookID)
+	slog.Info("Updated missing Hardcover info in book table")
+}
 
-	log.Println("Updated missing Hardcover info in book table")
+// backfillEditionPages fetches the page count of matched editions that do not have one yet: books matched before
+// page counts were stored and books resolved by hand. Editions without a page count on Hardcover are stored as 0
+// so they are not asked for again.
+func backfillEditionPages(ctx context.Context, client *http.Client, bookID string) {
+	var editions []int
+	err := kscribblerDB.Select(
+		&editions,
+		`SELECT DISTINCT hardcover_edition FROM book
+		WHERE match_state = ? AND hardcover_pages IS NULL
+		AND (? = '' OR book_id = ?);`,
+		matchStateMatched,
+		bookID,
+		bookID,
+	)
+	if err != nil {
+		slog.Error("failed to load editions without a page count", "error", err)
+		return
+	}
+	if len(editions) == 0 || ctx.Err() != nil {
+		return
+	}
+
+	ids := make([]string, len(editions))
+	for i, edition := range editions {
+		ids[i] = strconv.Itoa(edition)
+	}
+	var data struct {
+		Editions []struct {
+			ID    int  `json:"id"`
+			Pages *int `json:"pages"`
+		} `json:"editions"`
+	}
+	query := fmt.Sprintf(`query editionPages { editions(where: {id: {_in: [%s]}}) { id pages } }`, strings.Join(ids, ", "))
+	if err := postHardcoverQuery(client, ctx, query, nil, &data); err != nil {
+		slog.Error("failed to look up edition page counts", "editions", len(editions), "error", err)
+		return
+	}
+
+	for _, edition := range data.Editions {
+		pages := 0
+		if edition.Pages != nil {
+			pages = max(*edition.Pages, 0)
+		}
+		_, err := kscribblerDB.Exec(
+			`UPDATE book SET hardcover_pages = ? WHERE hardcover_edition = ? AND hardcover_pages IS NULL;`,
+			pages,
+			edition.ID,
+		)
+		if err != nil {
+			slog.Error("failed to store edition page count", "edition", edition.ID, "error", err)
+		}
+	}
+	slog.Info("Backfilled edition page counts", "editions", len(data.Editions))
+}
+
+// setMatchState records that bookID is not matched to Hardcover and why, shown by `kscribbler unmatched`, and when
+// it was looked up.
+func setMatchState(bookID string, state string, reason string) {
+	_, err := kscribblerDB.Exec(
+		`UPDATE book SET match_state = ?, match_error = ?, match_checked_at = strftime('%s', 'now') WHERE book_id = ?;`,
+		state,
+		reason,
+		bookID,
+	)
+	if err != nil {
+		slog.Error("failed to record why the book is unmatched", "book", bookID, "error", err)
+	}
 }
 
 // updateDBWithISBNs loops through all books with missing isbns and tries to populate them from their quotes and annotations.
@@ -278,7 +615,7 @@ func updateDBWithISBNs() {
 	err := kscribblerDB.Select(&books, `SELECT book_id, isbn FROM book WHERE isbn IS NULL;`)
 
 	if err != nil {
-		log.Printf("failed to load books with missing isbns: %v", err)
+		slog.Error("failed to load books with missing isbns", "error", err)
 		return
 	}
 
@@ -297,21 +634,27 @@ func updateDBWithISBNs() {
 			WHERE book_id = ?;
 		`, book.BookID)
 		if err != nil {
-			log.Printf("failed to load quotes for book %s: %v", book.BookID, err)
+			slog.Error("failed to load quotes for book", "book", book.BookID, "error", err)
 			continue
 		}
 		book.Bookmarks = quotes
 		book.SetIsbnFromBook()
 	}
 
-	log.Println("Updated missing ISBNs in book table")
+	slog.Info("Updated missing ISBNs in book table")
 	// TODO: figure out overriding precedence - 1. annotation, 2. highlights 3. isbn from KoboDB
 	// current approach is only a passthrough of things missing isbn
 	// also want to make sure isbn 13 is stored
 }
 
-// loadBooksFromDB loads books with pending quotes from the kscribbler database.
-func loadBooksFromDB() []Book {
+// noSyncNoteColumn selects whether any note of book b carries the kscrib:nosync directive.
+const noSyncNoteColumn = `EXISTS (
+	SELECT 1 FROM quote q WHERE q.book_id = b.book_id AND instr(lower(q.annotation), '` + noSyncDirective + `') > 0
+) AS nosync_note`
+
+// loadBooksFromDB loads books with pending quotes, or dogears and markups to upload, from the kscribbler database.
+// An empty bookID loads every book, otherwise only that book.
+func loadBooksFromDB(bookID string) []Book {
 	var books []Book
 
 	err := kscribblerDB.Select(&books, `
@@ -321,16 +664,22 @@ func loadBooksFromDB() []Book {
 			b.isbn,
 			b.hardcover_id,
 			b.hardcover_edition,
-			(SELECT COUNT(*) FROM quote q WHERE q.book_id = b.book_id AND q.kscribbler_uploaded = 0) AS pending_quotes
+			(SELECT COUNT(*) FROM quote q WHERE q.book_id = b.book_id AND `+readyQuoteFilter("q")+`) AS pending_quotes,
+			b.sync_policy,
+			`+noSyncNoteColumn+`
 		FROM book b
-		WHERE (SELECT COUNT(*) FROM quote q WHERE q.book_id = b.book_id AND q.kscribbler_uploaded = 0) > 0
-		AND b.hardcover_id IS NOT NULL
-		AND b.hardcover_edition IS NOT NULL
+		WHERE (
+			(SELECT COUNT(*) FROM quote q WHERE q.book_id = b.book_id AND `+readyQuoteFilter("q")+`) > 0
+			OR EXISTS (SELECT 1 FROM marker m WHERE m.book_id = b.book_id AND `+pendingMarkerFilter("m")+`)
+		)
+		AND b.match_state = ?
+		AND (? = '' OR b.book_id = ?)
 		ORDER BY b.book_id;
-		`)
+		`, matchStateMatched, bookID, bookID)
 	if err != nil {
-		log.Fatalf("failed to load books: %v", err)
+		fatal("failed to load books", "error", err)
 	}
+	books = filterBooksBySyncPolicy(books, bookID != "")
 
 	for i := range books {
 		err := kscribblerDB.Select(&books[i].Bookmarks, `
@@ -340,15 +689,143 @@ func loadBooksFromDB() []Book {
 				quote,
 				annotation,
 				page,
+				position,
+				(SELECT b.hardcover_pages FROM book b WHERE b.book_id = q.book_id) AS edition_pages,
+				(SELECT b.book_title FROM book b WHERE b.book_id = q.book_id) AS book_title,
+				chapter,
+				created_at,
+				color,
+				content_id,
+				start_path,
+				start_offset,
+				end_path,
+				end_offset,
 				type,
-				kscribbler_uploaded
-			FROM quote
-			WHERE book_id = ? AND kscribbler_uploaded = 0;
+				kscribbler_uploaded,
+				attempts,
+				uploaded_parts
+			FROM quote q
+			WHERE book_id = ? AND `+readyQuoteFilter("q")+`;
 		`, books[i].BookID)
 		if err != nil {
-			log.Fatalf("failed to load bookmarks for book %s: %v", books[i].BookID, err)
+			fatal("failed to load bookmarks for book", "book", books[i].BookID, "error", err)
 		}
+		if mergeHighlights {
+			books[i].Bookmarks = mergeAdjacentHighlights(books[i].Bookmarks)
+		}
+		books[i].Markers = loadMarkers(books[i].BookID, true)
+	}
+
+	return books
+}
+
+// loadLibraryStatus counts books and quotes for the status command.
+func loadLibraryStatus() LibraryStatus {
+	var status LibraryStatus
+	err := kscribblerDB.Get(&status, `
+		SELECT
+			(SELECT COUNT(*) FROM book) AS books,
+			(SELECT COUNT(*) FROM book WHERE match_state = ?) AS matched_books,
+			(SELECT COUNT(*) FROM quote) AS quotes,
+			(SELECT COUNT(*) FROM quote WHERE kscribbler_uploaded = 1) AS uploaded_quotes,
+			(SELECT COUNT(*) FROM quote WHERE kscribbler_uploaded = 0) AS pending_quotes,
+			(SELECT COUNT(*) FROM quote WHERE kscribbler_uploaded = 0 AND attempts > 0 AND attempts < ?) AS retrying_quotes,
+			(SELECT COUNT(*) FROM quote WHERE kscribbler_uploaded = 0 AND attempts >= ?) AS failed_quotes;
+	`, matchStateMatched, maxUploadAttempts, maxUploadAttempts)
+	if err != nil {
+		fatal("failed to load database status", "error", err)
 	}
+	return status
+}
 
+// listBooks loads every book with its pending quote count, optionally only those with pending quotes.
+func listBooks(pendingOnly bool) []Book {
+	var books []Book
+	err := kscribblerDB.Select(&books, `
+		SELECT
+			b.book_id,
+			b.book_title,
+			b.isbn,
+			b.hardcover_id,
+			b.hardcover_edition,
+			b.match_state,
+			b.edition_reason,
+			b.source,
+			b.sync_policy,
+			`+noSyncNoteColumn+`,
+			(SELECT COUNT(*) FROM quote q WHERE q.book_id = b.book_id AND q.kscribbler_uploaded = 0) AS pending_quotes
+		FROM book b
+		WHERE NOT ? OR (SELECT COUNT(*) FROM quote q WHERE q.book_id = b.book_id AND q.kscribbler_uploaded = 0) > 0
+		ORDER BY b.book_title;
+	`, pendingOnly)
+	if err != nil {
+		fatal("failed to list books", "error", err)
+	}
 	return books
 }
+
+// listQuotes loads quotes, optionally filtered by book, upload state and failed uploads. A limit of 0 lists everything.
+func listQuotes(bookID string, pendingOnly bool, failedOnly bool, limit int) []Bookmark {
+	if limit <= 0 {
+		limit = -1
+	}
+
+	var quotes []Bookmark
+	err := kscribblerDB.Select(&quotes, `
+		SELECT
+			bookmark_id,
+			book_id,
+			quote,
+			annotation,
+			page,
+			type,
+			kscribbler_uploaded,
+			attempts,
+			last_error
+		FROM quote
+		WHERE (? = '' OR book_id = ?)
+		AND (NOT ? OR kscribbler_uploaded = 0)
+		AND (NOT ? OR (kscribbler_uploaded = 0 AND attempts > 0))
+		ORDER BY book_id, page, bookmark_id
+		LIMIT ?;
+	`, bookID, bookID, pendingOnly, failedOnly, limit)
+	if err != nil {
+		fatal("failed to list quotes", "error", err)
+	}
+	return quotes
+}
+
+// markQuotes sets kscribbler_uploaded for every quote and marker, those of a book, or the given bookmark ids.
+// Returns the number of quotes and of markers marked.
+func markQuotes(all bool, bookID string, bookmarkIDs []string, uploaded bool) (int64, int64) {
+	var quotes, markers int64
+	update := func(where string, args ...any) {
+		for _, table := range []string{"quote", "marker"} {
+			result, err := kscribblerDB.Exec(
+				`UPDATE `+table+` SET kscribbler_uploaded = ? WHERE `+where+`;`,
+				append([]any{uploaded}, args...)...,
+			)
+			if err != nil {
+				fatal("failed to mark "+table+"s", "error", err)
+			}
+			rowsAffected, _ := result.RowsAffected()
+			if table == "quote" {
+				quotes += rowsAffected
+			} else {
+				markers += rowsAffected
+			}
+		}
+	}
+
+	switch {
+	case all:
+		update("1 = 1")
+	case bookID != "":
+		update("book_id = ?", bookID)
+	}
+	for _, id := range bookmarkIDs {
+		update("bookmark_id = ?", id)
+	}
+
+	return quotes, markers
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// doctorCheck prints the outcome of a single doctor check and returns whether it passed.
+func doctorCheck(name string, err error) bool {
+	if err != nil {
+		fmt.Printf("[FAIL] %s: %v\n", name, err)
+		return false
+	}
+	fmt.Printf("[ OK ] %s\n", name)
+	return true
+}
+
+// doctorWarn prints a problem that does not stop kscribbler from working.
+func doctorWarn(name string, detail string) {
+	fmt.Printf("[WARN] %s: %s\n", name, detail)
+}
+
+// runDoctor checks the configuration, databases and Hardcover connection. Returns true when every check passed.
+func runDoctor(offline bool) bool {
+	healthy := true
+
+	if _, err := os.Stat(configPath); err != nil {
+		doctorWarn("config file", fmt.Sprintf("%s not found, using the environment only", configPath))
+	} else {
+		doctorCheck("config file "+configPath, nil)
+	}
+
+	var tokenErr error
+	if authToken == "" {
+		tokenErr = fmt.Errorf("HARDCOVER_API_TOKEN is not set")
+	}
+	healthy = doctorCheck("HARDCOVER_API_TOKEN is set", tokenErr) && healthy
+	healthy = doctorCheck("journal entry templates", loadConfiguredTemplates()) && healthy
+
+	sources := configuredSources()
+	if len(sources) == 0 {
+		healthy = doctorCheck("highlight sources", fmt.Errorf("none configured")) && healthy
+	}
+	for _, source := range sources {
+		switch source.(type) {
+		case nickelSource:
+			healthy = doctorCheck("KoboReader.sqlite at "+koboDBPath, checkKoboDB()) && healthy
+		default:
+			doctorCheck("source "+source.Name(), nil)
+		}
+	}
+
+	if _, err := os.Stat(kscribblerDBPath); err != nil {
+		doctorWarn("kscribbler database", fmt.Sprintf("%s does not exist yet, run `kscribbler init`", kscribblerDBPath))
+	} else {
+		healthy = doctorCheck("kscribbler database at "+kscribblerDBPath, checkKscribblerDB()) && healthy
+	}
+
+	if offline {
+		return healthy
+	}
+
+	ctx, cancel := newRunContext()
+	defer cancel()
+	client := newHTTPClient()
+	if !doctorCheck("Hardcover API reachable", checkHardcoverConnection(client, ctx)) {
+		return false
+	}
+	if authToken != "" {
+		username, err := fetchHardcoverUsername(client, ctx)
+		if doctorCheck("Hardcover token is valid", err) {
+			fmt.Printf("       signed in as @%s\n", username)
+		} else {
+			healthy = false
+		}
+	}
+
+	return healthy
+}
+
+// checkKoboDB verifies that KoboReader.sqlite can be opened and has the tables kscribbler reads.
+func checkKoboDB() error {
+	koboDB, err := sqlx.Open("sqlite", "file:"+koboDBPath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer koboDB.Close()
+
+	for _, table := range []string{"content", "Bookmark"} {
+		var count int
+		if err := koboDB.Get(&count, "SELECT COUNT(*) FROM "+table); err != nil {
+			return fmt.Errorf("unable to read %s table: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// checkKscribblerDB verifies that kscribblerDB can be queried.
+func checkKscribblerDB() error {
+	db, err := sqlx.Open("sqlite", "file:"+kscribblerDBPath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.Get(&count, "SELECT COUNT(*) FROM quote"); err != nil {
+		return fmt.Errorf("unable to read quote table: %w", err)
+	}
+	return nil
+}
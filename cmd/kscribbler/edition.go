@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Hardcover edition fields requested by koboToHardcover for ranking.
+const editionFields = `
+					id
+					isbn_10
+					isbn_13
+					edition_format
+					pages
+					reading_format {
+						format
+					}
+					language {
+						code2
+						language
+					}
+					publisher {
+						name
+					}`
+
+// Represents a Hardcover edition returned by the book lookup.
+type HardcoverEdition struct {
+	ID            int    `json:"id"`
+	ISBN10        string `json:"isbn_10"`
+	ISBN13        string `json:"isbn_13"`
+	EditionFormat string `json:"edition_format"`
+	Pages         int    `json:"pages"`
+	ReadingFormat *struct {
+		Format string `json:"format"`
+	} `json:"reading_format"`
+	Language *struct {
+		Code2    string `json:"code2"`
+		Language string `json:"language"`
+	} `json:"language"`
+	Publisher *struct {
+		Name string `json:"name"`
+	} `json:"publisher"`
+}
+
+// editionCandidate is an edition of one of the books found for an ISBN, with its ranking score.
+type editionCandidate struct {
+	bookID  int
+	edition HardcoverEdition
+	score   int
+	reasons []string
+}
+
+// isEbook reports whether Hardcover lists the edition as an ebook.
+func (edition HardcoverEdition) isEbook() bool {
+	if edition.ReadingFormat != nil && strings.EqualFold(edition.ReadingFormat.Format, "ebook") {
+		return true
+	}
+	format := strings.ToLower(edition.EditionFormat)
+	for _, ebookFormat := range []string{"ebook", "e-book", "kindle", "kobo", "epub", "digital"} {
+		if strings.Contains(format, ebookFormat) {
+			return true
+		}
+	}
+	return false
+}
+
+// scoreEdition ranks an edition for book: an exact ISBN match outweighs everything, then an ebook edition, then
+// the book's language. Known page counts and publishers break ties since later steps rely on them.
+func scoreEdition(book Book, bookID int, edition HardcoverEdition) editionCandidate {
+	candidate := editionCandidate{bookID: bookID, edition: edition}
+	add := func(points int, reason string) {
+		candidate.score += points
+		candidate.reasons = append(candidate.reasons, reason)
+	}
+
+	isbn13 := book.SimpleISBN.ISBN13Number
+	isbn10 := book.SimpleISBN.ISBN10Number
+	if (isbn13 != "" && edition.ISBN13 == isbn13) || (isbn10 != "" && edition.ISBN10 == isbn10) {
+		add(100, "exact ISBN match")
+	}
+
+	if edition.isEbook() {
+		add(20, "ebook")
+	}
+
+	if language := bookLanguage(book); language != "" && edition.Language != nil && edition.Language.Code2 != "" {
+		if strings.EqualFold(edition.Language.Code2, language) {
+			add(10, "language "+language)
+		} else {
+			add(-10, "language "+edition.Language.Code2+" instead of "+language)
+		}
+	}
+
+	if edition.Pages > 0 {
+		add(2, fmt.Sprintf("%d pages", edition.Pages))
+	}
+	if edition.Publisher != nil && edition.Publisher.Name != "" {
+		add(1, edition.Publisher.Name)
+	}
+
+	return candidate
+}
+
+// bookLanguage returns the two letter language of the book as recorded by Nickel, e.g. "en" for "en-US".
+func bookLanguage(book Book) string {
+	language := strings.ToLower(strings.TrimSpace(book.Language.String))
+	if i := strings.IndexAny(language, "-_"); i > 0 {
+		language = language[:i]
+	}
+	return language
+}
+
+// rankEditions orders every edition of the found books best first, the editions with the ISBN and the ebook
+// editions merged. Equal scores keep the oldest edition id so repeated lookups pick the same edition.
+func rankEditions(book Book, response Response) []editionCandidate {
+	var candidates []editionCandidate
+	seen := map[int]bool{}
+	for _, found := range response.Data.Books {
+		for _, edition := range slices.Concat(found.Editions, found.EbookEditions) {
+			if seen[edition.ID] {
+				continue
+			}
+			seen[edition.ID] = true
+			candidates = append(candidates, scoreEdition(book, found.ID, edition))
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].edition.ID < candidates[j].edition.ID
+	})
+	return candidates
+}
+
+// editionReason explains why the first of the ranked candidates was chosen, stored in book.edition_reason.
+func editionReason(candidates []editionCandidate) string {
+	best := candidates[0]
+	reason := fmt.Sprintf("edition %d of book %d (score %d", best.edition.ID, best.bookID, best.score)
+	if len(best.reasons) > 0 {
+		reason += ": " + strings.Join(best.reasons, ", ")
+	}
+	reason += ")"
+
+	if len(candidates) > 1 {
+		runnerUp := candidates[1]
+		reason += fmt.Sprintf(
+			" over %d other candidates, next best edition %d (score %d)",
+			len(candidates)-1,
+			runnerUp.edition.ID,
+			runnerUp.score,
+		)
+	}
+	return reason
+}
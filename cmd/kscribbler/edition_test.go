@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/GianniBYoung/simpleISBN"
+)
+
+func TestScoreEdition(t *testing.T) {
+	book := Book{
+		SimpleISBN: simpleISBN.ISBN{ISBN13Number: "9781627792127", ISBN10Number: "1627792120"},
+		Language:   sql.NullString{String: "en-US", Valid: true},
+	}
+
+	tests := []struct {
+		name        string
+		edition     string
+		wantScore   int
+		wantReasons []string
+	}{
+		{"nothing known", `{"id": 1}`, 0, nil},
+		{"isbn 13", `{"id": 1, "isbn_13": "9781627792127"}`, 100, []string{"exact ISBN match"}},
+		{"isbn 10", `{"id": 1, "isbn_10": "1627792120"}`, 100, []string{"exact ISBN match"}},
+		{"other isbn", `{"id": 1, "isbn_13": "9781250076960"}`, 0, nil},
+		{"ebook reading format", `{"id": 1, "reading_format": {"format": "Ebook"}}`, 20, []string{"ebook"}},
+		{"ebook edition format", `{"id": 1, "edition_format": "Kindle Edition"}`, 20, []string{"ebook"}},
+		{"hardcover", `{"id": 1, "edition_format": "Hardcover", "reading_format": {"format": "Read"}}`, 0, nil},
+		{"same language", `{"id": 1, "language": {"code2": "EN"}}`, 10, []string{"language en"}},
+		{"other language", `{"id": 1, "language": {"code2": "de"}}`, -10, []string{"language de instead of en"}},
+		{
+			"everything",
+			`{"id": 1, "isbn_13": "9781627792127", "reading_format": {"format": "Ebook"}, "language": {"code2": "en"},
+			"pages": 536, "publisher": {"name": "Henry Holt"}}`,
+			133,
+			[]string{"exact ISBN match", "ebook", "language en", "536 pages", "Henry Holt"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var edition HardcoverEdition
+			if err := json.Unmarshal([]byte(tt.edition), &edition); err != nil {
+				t.Fatal(err)
+			}
+			got := scoreEdition(book, 7, edition)
+			if got.score != tt.wantScore || !reflect.DeepEqual(got.reasons, tt.wantReasons) {
+				t.Errorf("scoreEdition() = %d %q, want %d %q", got.score, got.reasons, tt.wantScore, tt.wantReasons)
+			}
+			if got.bookID != 7 || got.edition.ID != 1 {
+				t.Errorf("scoreEdition() = book %d edition %d, want book 7 edition 1", got.bookID, got.edition.ID)
+			}
+		})
+	}
+}
+
+func TestRankEditions(t *testing.T) {
+	book := Book{
+		SimpleISBN: simpleISBN.ISBN{ISBN13Number: "9781627792127"},
+		Language:   sql.NullString{String: "en", Valid: true},
+	}
+
+	tests := []struct {
+		name     string
+		response string
+		wantIDs  []int
+		wantBook int
+	}{
+		{
+			name:     "no books",
+			response: `{"data": {"books": []}}`,
+		},
+		{
+			name: "isbn match ranks above every capped ebook edition",
+			response: `{"data": {"books": [{"id": 7,
+				"editions": [{"id": 900, "isbn_13": "9781627792127"}],
+				"ebook_editions": [
+					{"id": 3, "reading_format": {"format": "Ebook"}, "language": {"code2": "en"}},
+					{"id": 2, "reading_format": {"format": "Ebook"}, "language": {"code2": "de"}}
+				]}]}}`,
+			wantIDs:  []int{900, 3, 2},
+			wantBook: 7,
+		},
+		{
+			name: "an ebook with the isbn is listed once",
+			response: `{"data": {"books": [{"id": 7,
+				"editions": [{"id": 5, "isbn_13": "9781627792127", "reading_format": {"format": "Ebook"}}],
+				"ebook_editions": [
+					{"id": 4, "reading_format": {"format": "Ebook"}},
+					{"id": 5, "isbn_13": "9781627792127", "reading_format": {"format": "Ebook"}}
+				]}]}}`,
+			wantIDs:  []int{5, 4},
+			wantBook: 7,
+		},
+		{
+			name: "equal scores keep the oldest edition",
+			response: `{"data": {"books": [
+				{"id": 8, "editions": [{"id": 12, "isbn_13": "9781627792127"}]},
+				{"id": 7, "editions": [{"id": 11, "isbn_13": "9781627792127"}]}
+			]}}`,
+			wantIDs:  []int{11, 12},
+			wantBook: 7,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response Response
+			if err := json.Unmarshal([]byte(tt.response), &response); err != nil {
+				t.Fatal(err)
+			}
+
+			candidates := rankEditions(book, response)
+			var ids []int
+			for _, candidate := range candidates {
+				ids = append(ids, candidate.edition.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Fatalf("rankEditions() = %v, want %v", ids, tt.wantIDs)
+			}
+			if len(candidates) > 0 && candidates[0].bookID != tt.wantBook {
+				t.Errorf("best candidate is of book %d, want %d", candidates[0].bookID, tt.wantBook)
+			}
+		})
+	}
+}
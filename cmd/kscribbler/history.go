@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/GianniBYoung/kscribbler/version"
+	"github.com/jmoiron/sqlx"
+)
+
+// currentRunID is the sync_run row upload events are attached to, 0 outside of a sync.
+var currentRunID int64
+
+// createHistoryTables adds the sync_run and upload_event tables to kscribblerDB.
+func createHistoryTables(db *sqlx.DB) {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS sync_run (
+		run_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		command TEXT NOT NULL,
+		version TEXT NOT NULL,
+		started_at INTEGER NOT NULL,
+		finished_at INTEGER,
+		new_books INTEGER NOT NULL DEFAULT 0,
+		new_quotes INTEGER NOT NULL DEFAULT 0,
+		uploaded INTEGER NOT NULL DEFAULT 0,
+		failed INTEGER NOT NULL DEFAULT 0,
+		skipped INTEGER NOT NULL DEFAULT 0,
+		unmatched INTEGER NOT NULL DEFAULT 0,
+		error TEXT
+	)
+`)
+	if err != nil {
+		fatal("failed to create sync_run table in kscribblerDB", "error", err)
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS upload_event (
+		event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id INTEGER REFERENCES sync_run(run_id),
+		bookmark_id TEXT NOT NULL,
+		book_id TEXT NOT NULL,
+		hardcover_id INTEGER,
+		hardcover_edition INTEGER,
+		created_at INTEGER NOT NULL,
+		uploaded INTEGER NOT NULL,
+		error TEXT
+	)
+`)
+	if err != nil {
+		fatal("failed to create upload_event table in kscribblerDB", "error", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS upload_event_bookmark ON upload_event(bookmark_id);`)
+	if err != nil {
+		fatal("failed to index upload_event table in kscribblerDB", "error", err)
+	}
+}
+
+// syncRun tracks one sync or retry from before kscribblerDB is populated until the last upload.
+type syncRun struct {
+	command      string
+	startedAt    time.Time
+	booksBefore  int
+	quotesBefore int
+}
+
+// newSyncRun notes the start time and the current size of kscribblerDB so new books and quotes can be counted.
+func newSyncRun(command string) *syncRun {
+	run := &syncRun{command: command, startedAt: time.Now()}
+	if _, err := os.Stat(kscribblerDBPath); err != nil {
+		return run
+	}
+
+	db := connectKscribblerDB()
+	defer db.Close()
+	row := db.QueryRow(`SELECT (SELECT COUNT(*) FROM book), (SELECT COUNT(*) FROM quote);`)
+	if err := row.Scan(&run.booksBefore, &run.quotesBefore); err != nil {
+		slog.Debug("failed to count rows before sync", "error", err)
+	}
+	return run
+}
+
+// begin stores the sync_run row once kscribblerDB has been populated and makes it the current run.
+func (run *syncRun) begin() {
+	db := connectKscribblerDB()
+	defer db.Close()
+
+	var booksAfter, quotesAfter int
+	row := db.QueryRow(`SELECT (SELECT COUNT(*) FROM book), (SELECT COUNT(*) FROM quote);`)
+	if err := row.Scan(&booksAfter, &quotesAfter); err != nil {
+		slog.Error("failed to count new books and quotes", "error", err)
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO sync_run(command, version, started_at, new_books, new_quotes)
+		VALUES (?, ?, ?, ?, ?);
+	`, run.command, version.Version, run.startedAt.Unix(), booksAfter-run.booksBefore, quotesAfter-run.quotesBefore)
+	if err != nil {
+		slog.Error("failed to record sync run", "error", err)
+		return
+	}
+	currentRunID, _ = result.LastInsertId()
+}
+
+// finish records the outcome of the current run. runErr is the error the command is about to return, if any.
+func (run *syncRun) finish(summary SyncSummary, runErr error) {
+	if currentRunID == 0 {
+		return
+	}
+
+	var errText sql.NullString
+	if runErr != nil {
+		errText = sql.NullString{String: runErr.Error(), Valid: true}
+	}
+
+	db := connectKscribblerDB()
+	defer db.Close()
+	_, err := db.Exec(`
+		UPDATE sync_run
+		SET finished_at = ?, uploaded = ?, failed = ?, skipped = ?, unmatched = ?, error = ?
+		WHERE run_id = ?;
+	`, time.Now().Unix(), summary.Uploaded+summary.Markers, summary.Failed, summary.Skipped, summary.Unmatched, errText, currentRunID)
+	if err != nil {
+		slog.Error("failed to record the end of the sync run", "run", currentRunID, "error", err)
+	}
+	currentRunID = 0
+}
+
+// recordUploadEvent logs an upload attempt of bm to book in upload_event. uploadErr is nil when it succeeded.
+func recordUploadEvent(bm Bookmark, book Book, uploadErr error) {
+	var runID sql.NullInt64
+	if currentRunID != 0 {
+		runID = sql.NullInt64{Int64: currentRunID, Valid: true}
+	}
+	var errText sql.NullString
+	if uploadErr != nil {
+		errText = sql.NullString{String: uploadErr.Error(), Valid: true}
+	}
+
+	// a merged entry is recorded for each of its bookmarks so `history --quote` finds all of them
+	for _, bookmarkID := range bm.bookmarkIDs() {
+		_, err := kscribblerDB.Exec(`
+			INSERT INTO upload_event(run_id, bookmark_id, book_id, hardcover_id, hardcover_edition, created_at, uploaded, error)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+		`, runID, bookmarkID, book.BookID, book.HardcoverID, book.HardcoverEdition, time.Now().Unix(), uploadErr == nil, errText)
+		if err != nil {
+			slog.Error("failed to record upload event", "bookmark", bookmarkID, "error", err)
+		}
+	}
+}
+
+// listSyncRuns loads the most recent runs, newest first.
+func listSyncRuns(limit int) []SyncRun {
+	if limit <= 0 {
+		limit = -1
+	}
+
+	var runs []SyncRun
+	err := kscribblerDB.Select(&runs, `
+		SELECT run_id, command, version, started_at, finished_at, new_books, new_quotes,
+			uploaded, failed, skipped, unmatched, error
+		FROM sync_run
+		ORDER BY run_id DESC
+		LIMIT ?;
+	`, limit)
+	if err != nil {
+		fatal("failed to list sync runs", "error", err)
+	}
+	return runs
+}
+
+// listUploadEvents loads the upload events of a run or of a quote, oldest first.
+func listUploadEvents(runID int64, bookmarkID string) []UploadEvent {
+	var events []UploadEvent
+	err := kscribblerDB.Select(&events, `
+		SELECT e.event_id, e.run_id, r.version, e.bookmark_id, e.book_id, e.hardcover_id, e.hardcover_edition,
+			e.created_at, e.uploaded, e.error
+		FROM upload_event e
+		LEFT JOIN sync_run r ON r.run_id = e.run_id
+		WHERE (? = 0 OR e.run_id = ?)
+		AND (? = '' OR e.bookmark_id = ?)
+		ORDER BY e.event_id;
+	`, runID, runID, bookmarkID, bookmarkID)
+	if err != nil {
+		fatal("failed to list upload events", "error", err)
+	}
+	return events
+}
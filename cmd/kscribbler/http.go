@@ -6,8 +6,16 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	_ "embed"
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 //go:embed certs/bundle.pem
@@ -15,33 +23,42 @@ var hardcoverCert []byte
 
 const apiURL = "https://api.hardcover.app/v1/graphql"
 
+// Hardcover allows 60 requests a minute per token; stay a little below by default.
+var requestsPerMinute = 50
+
+// requestTimeout bounds a single request so a dropped Wi-Fi connection cannot hang the sync.
+var requestTimeout = 30 * time.Second
+
+// maxThrottleRetries bounds how often a single request is resent after Hardcover throttled it.
+const maxThrottleRetries = 5
+
 // newHTTPClient with system CA bundle and embedded CA for api.hardcover.app
 func newHTTPClient() *http.Client {
 	// Start with the system certificate pool
 	pool, err := x509.SystemCertPool()
 	if err != nil {
 		// If system pool is unavailable, create a new pool
-		log.Printf("Warning: Unable to load system certificate pool: %v", err)
+		slog.Warn("Unable to load system certificate pool", "error", err)
 		pool = x509.NewCertPool()
 	}
 
 	// Append the embedded Let's Encrypt certificate as a fallback
 	if !pool.AppendCertsFromPEM(hardcoverCert) {
-		log.Printf("Warning: Failed to parse embedded CA bundle")
+		slog.Warn("Failed to parse embedded CA bundle")
 	}
 
 	tlsConfig := &tls.Config{
 		RootCAs: pool,
 	}
 	transport := &http.Transport{TLSClientConfig: tlsConfig}
-	return &http.Client{Transport: transport}
+	return &http.Client{Transport: &throttledTransport{next: transport}}
 }
 
 // newHardcoverRequest creates a new HTTP request to the Hardcover API with the appropriate headers.
-func newHardcoverRequest(ctx context.Context, body []byte) *http.Request {
+func newHardcoverRequest(ctx context.Context, body []byte) (*http.Request, error) {
 	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer(body))
 	if err != nil {
-		log.Fatalf("Failed to create newHardcoverRequest: %v", err)
+		return nil, fmt.Errorf("failed to create Hardcover request: %w", err)
 	}
 
 	req.Header.Set("Authorization", authToken)
@@ -51,19 +68,260 @@ func newHardcoverRequest(ctx context.Context, body []byte) *http.Request {
 		"kscribbler - https://github.com/GianniBYoung/kscribbler",
 	)
 
-	return req
+	return req, nil
+}
+
+// postHardcoverQuery sends a GraphQL query with its variables, which may be nil, and decodes the data of the
+// response into data. Every query and mutation is sent through it.
+func postHardcoverQuery(client *http.Client, ctx context.Context, query string, variables map[string]any, data any) error {
+	request := map[string]any{"query": query}
+	if variables != nil {
+		request["variables"] = variables
+	}
+	bodyBytes, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode GraphQL request: %w", err)
+	}
+
+	req, err := newHardcoverRequest(ctx, bodyBytes)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	rawResp, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	slog.Debug("Hardcover response", "body", string(rawResp))
+
+	var response struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(rawResp, &response); err != nil {
+		return fmt.Errorf("failed to unmarshal response (status %d): %w", resp.StatusCode, err)
+	}
+	if len(response.Errors) > 0 {
+		return fmt.Errorf("hardcover GraphQL error: %s", response.Errors[0].Message)
+	}
+	if err := json.Unmarshal(response.Data, data); err != nil {
+		return fmt.Errorf("failed to unmarshal response data: %w", err)
+	}
+	return nil
 }
 
-func verifyHardcoverConnection(client *http.Client, ctx context.Context) {
-	req := newHardcoverRequest(ctx, []byte(`{"query": "conenctiontest  e { id }}"}`))
+// checkHardcoverConnection reports whether the Hardcover API can be reached.
+func checkHardcoverConnection(client *http.Client, ctx context.Context) error {
+	req, err := newHardcoverRequest(ctx, []byte(`{"query": "conenctiontest  e { id }}"}`))
+	if err != nil {
+		return err
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("Failed to connect to Hardcover API: %v", err)
+		return fmt.Errorf("failed to connect to Hardcover API: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("Hardcover API returned non-200 status: %d %s", resp.StatusCode, resp.Status)
+		return fmt.Errorf("hardcover API returned non-200 status: %d %s", resp.StatusCode, resp.Status)
+	}
+	return nil
+}
+
+// fetchHardcoverUsername returns the username the API token belongs to, which also validates the token.
+func fetchHardcoverUsername(client *http.Client, ctx context.Context) (string, error) {
+	var response Response
+	if err := postHardcoverQuery(client, ctx, `query me { me { id username } }`, nil, &response.Data); err != nil {
+		return "", err
+	}
+	if len(response.Data.Me) < 1 {
+		return "", fmt.Errorf("hardcover did not return a user for this token")
+	}
+
+	return response.Data.Me[0].Username, nil
+}
+
+// requestScheduler spaces requests so that no more than requestsPerMinute are sent. It is shared by every
+// client so lookups and uploads draw from the same budget.
+type requestScheduler struct {
+	mu       sync.Mutex
+	nextSlot time.Time
+}
+
+var hardcoverScheduler = &requestScheduler{}
+
+// wait blocks until the next request may be sent or ctx is done.
+func (s *requestScheduler) wait(ctx context.Context) error {
+	interval := time.Minute / time.Duration(max(requestsPerMinute, 1))
+
+	s.mu.Lock()
+	now := time.Now()
+	slot := s.nextSlot
+	if slot.Before(now) {
+		slot = now
+	}
+	s.nextSlot = slot.Add(interval)
+	s.mu.Unlock()
+
+	return sleepContext(ctx, time.Until(slot))
+}
+
+// pause pushes the next slot back after Hardcover asked us to slow down.
+func (s *requestScheduler) pause(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if resume := time.Now().Add(d); resume.After(s.nextSlot) {
+		s.nextSlot = resume
+	}
+}
+
+// sleepContext sleeps for d unless ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledTransport sends requests through hardcoverScheduler and resends requests that Hardcover throttled,
+// either with HTTP 429 or with a throttling GraphQL error, once the requested delay has passed.
+type throttledTransport struct {
+	next http.RoundTripper
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	for attempt := 0; ; attempt++ {
+		if err := hardcoverScheduler.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.send(req, attempt)
+		if err != nil {
+			return nil, err
+		}
+
+		delay, throttled := throttleDelay(resp, attempt)
+		if !throttled || attempt >= maxThrottleRetries {
+			return resp, nil
+		}
+
+		slog.Warn("Hardcover throttled the request", "resume_in", delay)
+		hardcoverScheduler.pause(delay)
+	}
+}
+
+// send performs one attempt of req within requestTimeout. The body is read in full before the deadline is
+// released, so the returned response can be read without blocking.
+func (t *throttledTransport) send(req *http.Request, attempt int) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), requestTimeout)
+	defer cancel()
+
+	attemptReq := req.Clone(ctx)
+	if attempt > 0 {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("request to %s was throttled and cannot be resent", req.URL)
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		attemptReq.Body = body
+	}
+
+	resp, err := t.next.RoundTrip(attemptReq)
+	if err == nil {
+		var raw []byte
+		raw, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(raw))
+	}
+	if err != nil {
+		if req.Context().Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("request to Hardcover timed out after %s: %w", requestTimeout, err)
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// throttleDelay reports whether resp is a throttling response, by HTTP 429 or a GraphQL throttling error,
+// and how long to wait before resending.
+func throttleDelay(resp *http.Response, attempt int) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		if resp.StatusCode != http.StatusOK {
+			return 0, false
+		}
+		raw, _ := io.ReadAll(resp.Body)
+		resp.Body = io.NopCloser(bytes.NewReader(raw))
+		if !isThrottledResponse(raw) {
+			return 0, false
+		}
+	}
+
+	if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+		return delay, true
+	}
+	// without a Retry-After header back off 15s, 30s, 60s, ...
+	return 15 * time.Second << attempt, true
+}
+
+// isThrottledResponse looks for a throttling error in a GraphQL response body.
+func isThrottledResponse(raw []byte) bool {
+	var body struct {
+		Error  string `json:"error"`
+		Errors []struct {
+			Message    string `json:"message"`
+			Extensions struct {
+				Code string `json:"code"`
+			} `json:"extensions"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return false
+	}
+
+	messages := []string{body.Error}
+	for _, e := range body.Errors {
+		messages = append(messages, e.Message, e.Extensions.Code)
+	}
+	for _, message := range messages {
+		message = strings.ToLower(message)
+		if strings.Contains(message, "throttl") || strings.Contains(message, "rate limit") ||
+			strings.Contains(message, "too many requests") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
 	}
+	return 0, false
 }
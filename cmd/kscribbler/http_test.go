@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"seconds", "120", 120 * time.Second, true},
+		{"seconds with spaces", " 5 ", 5 * time.Second, true},
+		{"zero", "0", 0, true},
+		{"negative", "-1", 0, false},
+		{"empty", "", 0, false},
+		{"garbage", "soon", 0, false},
+		{"date in the past", "Wed, 21 Oct 2015 07:28:00 GMT", 0, true},
+		{"date in the future", time.Now().Add(90 * time.Second).UTC().Format(http.TimeFormat), 90 * time.Second, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value)
+			if ok != tt.wantOK {
+				t.Fatalf("parseRetryAfter(%q) ok = %t, want %t", tt.value, ok, tt.wantOK)
+			}
+			// HTTP dates have a resolution of one second
+			if got > tt.want || got < tt.want-2*time.Second {
+				t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThrottledTransportRetries(t *testing.T) {
+	defer func(rpm int, scheduler *requestScheduler) {
+		requestsPerMinute, hardcoverScheduler = rpm, scheduler
+	}(requestsPerMinute, hardcoverScheduler)
+	requestsPerMinute = 6000
+
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"http 429", http.StatusTooManyRequests, `{"error": "Too Many Requests"}`},
+		{"graphql throttling error", http.StatusOK, `{"errors": [{"message": "Throttled"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hardcoverScheduler = &requestScheduler{}
+
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != `{"query": "q"}` {
+					t.Errorf("request %d body = %q", requests.Load()+1, body)
+				}
+				if requests.Add(1) == 1 {
+					w.Header().Set("Retry-After", "1")
+					w.WriteHeader(tt.status)
+					w.Write([]byte(tt.body))
+					return
+				}
+				w.Write([]byte(`{"data": {}}`))
+			}))
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader([]byte(`{"query": "q"}`)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client := &http.Client{Transport: &throttledTransport{next: http.DefaultTransport}}
+			start := time.Now()
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if elapsed := time.Since(start); elapsed < time.Second {
+				t.Errorf("retried after %s, want at least the 1s of Retry-After", elapsed)
+			}
+			if n := requests.Load(); n != 2 {
+				t.Errorf("server got %d requests, want 2", n)
+			}
+			if resp.StatusCode != http.StatusOK || string(body) != `{"data": {}}` {
+				t.Errorf("response = %d %q, want the retried response", resp.StatusCode, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const kindleClippingSeparator = "=========="
+
+var kindlePageRegex = regexp.MustCompile(`(?i)\bpage\s+(\d+)`)
+var kindleLocationRegex = regexp.MustCompile(`(?i)\blocation\s+(\d+)(?:-(\d+))?`)
+var kindleAddedRegex = regexp.MustCompile(`(?i)\|\s*added on\s+(.+)$`)
+
+// kindleSource imports highlights and notes from a Kindle `My Clippings.txt` file.
+type kindleSource struct {
+	path string
+}
+
+func (source kindleSource) Name() string {
+	return "kindle"
+}
+
+// Populate parses the clippings file and stores its highlights.
+func (source kindleSource) Populate() error {
+	raw, err := os.ReadFile(source.path)
+	if err != nil {
+		return fmt.Errorf("failed to read Kindle clippings %s: %w", source.path, err)
+	}
+
+	books := parseKindleClippings(source.path, string(raw))
+	slog.Info("Found books in Kindle clippings", "books", len(books), "path", source.path)
+	insertImportedBooks(source.Name(), books)
+	return nil
+}
+
+// kindleClipping is one `==========` delimited entry of My Clippings.txt.
+type kindleClipping struct {
+	title         string
+	kind          string
+	page          int64
+	locationStart int64
+	locationEnd   int64
+	added         string
+	text          string
+}
+
+// parseKindleClipping parses the title line, the metadata line and the body of a single clipping.
+func parseKindleClipping(entry string) (kindleClipping, bool) {
+	lines := strings.Split(strings.TrimSpace(entry), "\n")
+	if len(lines) < 2 {
+		return kindleClipping{}, false
+	}
+
+	clipping := kindleClipping{title: strings.TrimSpace(lines[0])}
+	meta := strings.TrimSpace(lines[1])
+	lowerMeta := strings.ToLower(meta)
+
+	switch {
+	case strings.Contains(lowerMeta, "highlight"):
+		clipping.kind = "highlight"
+	case strings.Contains(lowerMeta, "note"):
+		clipping.kind = "note"
+	default:
+		// bookmarks and clips carry no text worth uploading
+		return kindleClipping{}, false
+	}
+
+	if match := kindlePageRegex.FindStringSubmatch(meta); match != nil {
+		clipping.page, _ = strconv.ParseInt(match[1], 10, 64)
+	}
+	if match := kindleLocationRegex.FindStringSubmatch(meta); match != nil {
+		clipping.locationStart, _ = strconv.ParseInt(match[1], 10, 64)
+		clipping.locationEnd = clipping.locationStart
+		if match[2] != "" {
+			clipping.locationEnd, _ = strconv.ParseInt(match[2], 10, 64)
+		}
+	}
+	if match := kindleAddedRegex.FindStringSubmatch(meta); match != nil {
+		clipping.added = strings.TrimSpace(match[1])
+	}
+
+	clipping.text = strings.TrimSpace(strings.Join(lines[2:], "\n"))
+	return clipping, clipping.text != ""
+}
+
+// parseKindleClippings splits the file into clippings and builds one book per title.
+func parseKindleClippings(path string, raw string) []ImportedBook {
+	// Kindles write a byte order mark at the start of every clipping, not only of the file
+	raw = strings.ReplaceAll(raw, "\ufeff", "")
+	raw = strings.ReplaceAll(raw, "\r\n", "\n")
+
+	var titles []string
+	clippingsByTitle := map[string][]kindleClipping{}
+	for _, entry := range strings.Split(raw, kindleClippingSeparator) {
+		clipping, ok := parseKindleClipping(entry)
+		if !ok {
+			continue
+		}
+		if _, exists := clippingsByTitle[clipping.title]; !exists {
+			titles = append(titles, clipping.title)
+		}
+		clippingsByTitle[clipping.title] = append(clippingsByTitle[clipping.title], clipping)
+	}
+
+	var books []ImportedBook
+	for _, title := range titles {
+		books = append(books, newKindleBook(path, title, clippingsByTitle[title]))
+	}
+	return books
+}
+
+// newKindleBook builds the book for one title. A note belongs to the highlight whose location range contains it;
+// unattached notes are kept only when they are `kscrib:` directives so an ISBN can be set without a highlight.
+func newKindleBook(path string, title string, clippings []kindleClipping) ImportedBook {
+	sum := sha1.Sum([]byte(title))
+	book := ImportedBook{
+		BookID: "kindle:" + hex.EncodeToString(sum[:10]),
+		Title:  kindleTitle(title),
+		Origin: path,
+	}
+
+	var highlights []kindleClipping
+	var notes []kindleClipping
+	for _, clipping := range clippings {
+		if clipping.kind == "note" {
+			notes = append(notes, clipping)
+		} else {
+			highlights = append(highlights, clipping)
+		}
+	}
+
+	used := make([]bool, len(notes))
+	for _, highlight := range highlights {
+		imported := ImportedHighlight{
+			Text:     highlight.text,
+			Datetime: highlight.added,
+			Page:     highlight.page,
+		}
+		for i, note := range notes {
+			if !used[i] && note.locationStart >= highlight.locationStart &&
+				note.locationStart <= highlight.locationEnd {
+				imported.Note = note.text
+				used[i] = true
+				break
+			}
+		}
+
+		location := fmt.Sprintf("%d-%d", highlight.locationStart, highlight.locationEnd)
+		idSum := sha1.Sum([]byte(book.BookID + "|" + location + "|" + highlight.text))
+		imported.BookmarkID = "kindle:" + hex.EncodeToString(idSum[:])
+		book.Highlights = append(book.Highlights, imported)
+	}
+
+	for i, note := range notes {
+		if used[i] {
+			continue
+		}
+		if !strings.Contains(strings.ToLower(note.text), "kscrib:") {
+			slog.Info("Skipping Kindle note without a matching highlight", "title", book.Title, "note", note.text)
+			continue
+		}
+		idSum := sha1.Sum([]byte(book.BookID + "|note|" + note.text))
+		book.Highlights = append(book.Highlights, ImportedHighlight{
+			BookmarkID: "kindle:" + hex.EncodeToString(idSum[:]),
+			Text:       note.text,
+			Note:       note.text,
+			Datetime:   note.added,
+		})
+	}
+
+	return book
+}
+
+// kindleTitle strips the trailing `(Author)` from a clippings title line.
+func kindleTitle(titleLine string) string {
+	if i := strings.LastIndex(titleLine, " ("); i > 0 && strings.HasSuffix(titleLine, ")") {
+		return strings.TrimSpace(titleLine[:i])
+	}
+	return titleLine
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKindleClipping(t *testing.T) {
+	tests := []struct {
+		name   string
+		entry  string
+		want   kindleClipping
+		wantOK bool
+	}{
+		{
+			name: "highlight with page and location",
+			entry: "The Book (An Author)\n- Your Highlight on page 12 | Location 180-182 | Added on Monday, 1 January 2024 10:00:00\n\n" +
+				"Some highlighted text.\n",
+			want: kindleClipping{
+				title:         "The Book (An Author)",
+				kind:          "highlight",
+				page:          12,
+				locationStart: 180,
+				locationEnd:   182,
+				added:         "Monday, 1 January 2024 10:00:00",
+				text:          "Some highlighted text.",
+			},
+			wantOK: true,
+		},
+		{
+			name:  "note at a single location",
+			entry: "\nThe Book (An Author)\n- Your Note on Location 181 | Added on Monday, 1 January 2024 10:01:00\n\nMy note\non two lines",
+			want: kindleClipping{
+				title:         "The Book (An Author)",
+				kind:          "note",
+				locationStart: 181,
+				locationEnd:   181,
+				added:         "Monday, 1 January 2024 10:01:00",
+				text:          "My note\non two lines",
+			},
+			wantOK: true,
+		},
+		{
+			name:  "bookmark",
+			entry: "The Book (An Author)\n- Your Bookmark on Location 200 | Added on Monday, 1 January 2024 10:02:00\n\n",
+		},
+		{
+			name:  "highlight without text",
+			entry: "The Book (An Author)\n- Your Highlight on Location 10-12 | Added on Monday, 1 January 2024 10:02:00\n\n",
+		},
+		{
+			name:  "title only",
+			entry: "The Book (An Author)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseKindleClipping(tt.entry)
+			if ok != tt.wantOK {
+				t.Fatalf("parseKindleClipping() ok = %t, want %t", ok, tt.wantOK)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseKindleClipping() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKindleClippings(t *testing.T) {
+	clipping := func(title, meta, text string) string {
+		return title + "\n- " + meta + " | Added on Monday, 1 January 2024 10:00:00\n\n" + text + "\n==========\n"
+	}
+
+	tests := []struct {
+		name       string
+		raw        string
+		wantTitles []string
+		wantTexts  [][]string
+		wantNotes  [][]string
+	}{
+		{
+			name: "note paired with the highlight containing it",
+			raw: clipping("Book A (Author)", "Your Highlight on Location 10-15", "first") +
+				clipping("Book A (Author)", "Your Highlight on Location 20-25", "second") +
+				clipping("Book A (Author)", "Your Note on Location 25", "about second") +
+				clipping("Book A (Author)", "Your Note on Location 90", "stray note") +
+				clipping("Book A (Author)", "Your Note on Location 91", "kscrib:9780306406157"),
+			wantTitles: []string{"Book A"},
+			wantTexts:  [][]string{{"first", "second", "kscrib:9780306406157"}},
+			wantNotes:  [][]string{{"", "about second", "kscrib:9780306406157"}},
+		},
+		{
+			name: "BOM and CRLF",
+			raw: strings.ReplaceAll(
+				"\ufeff"+clipping("Book A (Author)", "Your Highlight on page 3 | Location 10-15", "first line\nsecond line")+
+					"\ufeff"+clipping("Book B (Other Author)", "Your Highlight on Location 5-6", "other book")+
+					"\ufeff"+clipping("Book A (Author)", "Your Highlight on Location 30-31", "third"),
+				"\n", "\r\n",
+			),
+			wantTitles: []string{"Book A", "Book B"},
+			wantTexts:  [][]string{{"first line\nsecond line", "third"}, {"other book"}},
+			wantNotes:  [][]string{{"", ""}, {""}},
+		},
+		{
+			name:       "one note per highlight",
+			raw:        clipping("Book A (Author)", "Your Highlight on Location 10-15", "first") + clipping("Book A (Author)", "Your Note on Location 12", "one") + clipping("Book A (Author)", "Your Note on Location 13", "two"),
+			wantTitles: []string{"Book A"},
+			wantTexts:  [][]string{{"first"}},
+			wantNotes:  [][]string{{"one"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			books := parseKindleClippings("My Clippings.txt", tt.raw)
+
+			var titles []string
+			var texts, notes [][]string
+			ids := map[string]bool{}
+			for _, book := range books {
+				titles = append(titles, book.Title)
+				var bookTexts, bookNotes []string
+				for _, h := range book.Highlights {
+					bookTexts = append(bookTexts, h.Text)
+					bookNotes = append(bookNotes, h.Note)
+					if ids[h.BookmarkID] {
+						t.Errorf("duplicate bookmark id %q", h.BookmarkID)
+					}
+					ids[h.BookmarkID] = true
+				}
+				texts = append(texts, bookTexts)
+				notes = append(notes, bookNotes)
+			}
+
+			if !reflect.DeepEqual(titles, tt.wantTitles) {
+				t.Errorf("titles = %q, want %q", titles, tt.wantTitles)
+			}
+			if !reflect.DeepEqual(texts, tt.wantTexts) {
+				t.Errorf("texts = %q, want %q", texts, tt.wantTexts)
+			}
+			if !reflect.DeepEqual(notes, tt.wantNotes) {
+				t.Errorf("notes = %q, want %q", notes, tt.wantNotes)
+			}
+		})
+	}
+}
+
+func TestKindleTitle(t *testing.T) {
+	tests := map[string]string{
+		"The Book (An Author)":               "The Book",
+		"The Book (Series 1) (An Author)":    "The Book (Series 1)",
+		"The Book":                           "The Book",
+		"(Only Parentheses)":                 "(Only Parentheses)",
+		"The Book (An Author) and more text": "The Book (An Author) and more text",
+	}
+	for line, want := range tests {
+		if got := kindleTitle(line); got != want {
+			t.Errorf("kindleTitle(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var koreaderSidecarRegex = regexp.MustCompile(`^metadata\..+\.lua$`)
+var koreaderISBNRegex = regexp.MustCompile(`97[89][-0-9]{10,16}|[0-9][-0-9]{8,12}[0-9Xx]`)
+
+// Legacy KOReader fills a bookmark's text with "Page %1 %2 @ %3" (page, highlight, datetime) until it is edited.
+var koreaderLegacyNoteRegex = regexp.MustCompile(`(?s)^Page \S+ (.*?)(?: @ \d{4}-\d\d-\d\d \d\d:\d\d:\d\d)?$`)
+
+// luaParser reads the subset of Lua produced by KOReader's docsettings serializer: a single returned table literal.
+type luaParser struct {
+	src string
+	pos int
+}
+
+// parseLuaTable parses a KOReader sidecar file into nested maps. Integer keys are stored as their decimal string.
+func parseLuaTable(src string) (map[string]any, error) {
+	p := &luaParser{src: src}
+	p.skip()
+	if strings.HasPrefix(p.src[p.pos:], "return") {
+		p.pos += len("return")
+	}
+	p.skip()
+
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	table, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("sidecar does not return a table")
+	}
+	return table, nil
+}
+
+// skip advances past whitespace and comments.
+func (p *luaParser) skip() {
+	for p.pos < len(p.src) {
+		switch {
+		case strings.ContainsRune(" \t\r\n", rune(p.src[p.pos])):
+			p.pos++
+		case strings.HasPrefix(p.src[p.pos:], "--[["):
+			end := strings.Index(p.src[p.pos:], "]]")
+			if end < 0 {
+				p.pos = len(p.src)
+				return
+			}
+			p.pos += end + 2
+		case strings.HasPrefix(p.src[p.pos:], "--"):
+			end := strings.IndexByte(p.src[p.pos:], '\n')
+			if end < 0 {
+				p.pos = len(p.src)
+				return
+			}
+			p.pos += end + 1
+		default:
+			return
+		}
+	}
+}
+
+func (p *luaParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("lua parse error at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// value parses a table, string, number, boolean or nil.
+func (p *luaParser) value() (any, error) {
+	p.skip()
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("unexpected end of input")
+	}
+
+	switch c := p.src[p.pos]; {
+	case c == '{':
+		return p.table()
+	case c == '"' || c == '\'':
+		return p.quotedString()
+	case strings.HasPrefix(p.src[p.pos:], "[["):
+		return p.longString()
+	case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		return p.number()
+	}
+
+	for _, keyword := range []string{"true", "false", "nil"} {
+		if strings.HasPrefix(p.src[p.pos:], keyword) {
+			p.pos += len(keyword)
+			switch keyword {
+			case "true":
+				return true, nil
+			case "false":
+				return false, nil
+			}
+			return nil, nil
+		}
+	}
+
+	return nil, p.errorf("unexpected character %q", p.src[p.pos])
+}
+
+// table parses `{ [key] = value, name = value, value, ... }`.
+func (p *luaParser) table() (map[string]any, error) {
+	p.pos++ // {
+	table := map[string]any{}
+	nextIndex := 1
+
+	for {
+		p.skip()
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unterminated table")
+		}
+		if p.src[p.pos] == '}' {
+			p.pos++
+			return table, nil
+		}
+
+		var key string
+		switch {
+		case p.src[p.pos] == '[' && !strings.HasPrefix(p.src[p.pos:], "[["):
+			p.pos++
+			k, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			key = luaKey(k)
+			p.skip()
+			if p.pos >= len(p.src) || p.src[p.pos] != ']' {
+				return nil, p.errorf("expected ]")
+			}
+			p.pos++
+			p.skip()
+			if p.pos >= len(p.src) || p.src[p.pos] != '=' {
+				return nil, p.errorf("expected =")
+			}
+			p.pos++
+		default:
+			if name, ok := p.identifierKey(); ok {
+				key = name
+			} else {
+				key = strconv.Itoa(nextIndex)
+				nextIndex++
+			}
+		}
+
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		table[key] = v
+
+		p.skip()
+		if p.pos < len(p.src) && (p.src[p.pos] == ',' || p.src[p.pos] == ';') {
+			p.pos++
+		}
+	}
+}
+
+// identifierKey consumes `name =` if present.
+func (p *luaParser) identifierKey() (string, bool) {
+	start := p.pos
+	end := start
+	for end < len(p.src) {
+		c := p.src[end]
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (end > start && c >= '0' && c <= '9') {
+			end++
+			continue
+		}
+		break
+	}
+	if end == start {
+		return "", false
+	}
+
+	rest := strings.TrimLeft(p.src[end:], " \t\r\n")
+	if !strings.HasPrefix(rest, "=") || strings.HasPrefix(rest, "==") {
+		return "", false
+	}
+	p.pos = len(p.src) - len(rest) + 1
+	return p.src[start:end], true
+}
+
+// quotedString parses a single or double quoted string with Lua escapes.
+func (p *luaParser) quotedString() (string, error) {
+	quote := p.src[p.pos]
+	p.pos++
+
+	var sb strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == quote:
+			p.pos++
+			return sb.String(), nil
+		case c == '\\' && p.pos+1 < len(p.src):
+			p.pos++
+			e := p.src[p.pos]
+			switch e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case '\n':
+				sb.WriteByte('\n')
+			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+				end := p.pos
+				for end < len(p.src) && end < p.pos+3 && p.src[end] >= '0' && p.src[end] <= '9' {
+					end++
+				}
+				code, _ := strconv.Atoi(p.src[p.pos:end])
+				sb.WriteByte(byte(code))
+				p.pos = end - 1
+			default:
+				sb.WriteByte(e)
+			}
+			p.pos++
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// longString parses a `[[ ... ]]` string.
+func (p *luaParser) longString() (string, error) {
+	p.pos += 2
+	end := strings.Index(p.src[p.pos:], "]]")
+	if end < 0 {
+		return "", p.errorf("unterminated long string")
+	}
+	s := strings.TrimPrefix(p.src[p.pos:p.pos+end], "\n")
+	p.pos += end + 2
+	return s, nil
+}
+
+// number parses an integer or float literal.
+func (p *luaParser) number() (any, error) {
+	start := p.pos
+	for p.pos < len(p.src) && strings.ContainsRune("+-.0123456789eExXabcdefABCDEF", rune(p.src[p.pos])) {
+		p.pos++
+	}
+	literal := p.src[start:p.pos]
+	if i, err := strconv.ParseInt(literal, 0, 64); err == nil {
+		return i, nil
+	}
+	f, err := strconv.ParseFloat(literal, 64)
+	if err != nil {
+		return nil, p.errorf("invalid number %q", literal)
+	}
+	return f, nil
+}
+
+// luaKey converts a bracketed table key to the string used in the parsed map.
+func luaKey(k any) string {
+	switch v := k.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(k)
+}
+
+// luaList returns the integer-keyed entries of a table in index order.
+func luaList(v any) []map[string]any {
+	table, ok := v.(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	var indexes []int
+	for k := range table {
+		if i, err := strconv.Atoi(k); err == nil {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+
+	var list []map[string]any
+	for _, i := range indexes {
+		if entry, ok := table[strconv.Itoa(i)].(map[string]any); ok {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+func luaString(table map[string]any, key string) string {
+	s, _ := table[key].(string)
+	return strings.TrimSpace(s)
+}
+
+func luaInt(table map[string]any, key string) (int64, bool) {
+	switch v := table[key].(type) {
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// newKOReaderBook converts a parsed sidecar into a book with its highlights.
+func newKOReaderBook(path string, sidecar map[string]any) ImportedBook {
+	doc := ImportedBook{Origin: path}
+
+	props, _ := sidecar["doc_props"].(map[string]any)
+	if props != nil {
+		doc.Title = luaString(props, "title")
+		for _, line := range strings.Split(luaString(props, "identifiers"), "\n") {
+			if !strings.Contains(strings.ToLower(line), "isbn") {
+				continue
+			}
+			if match := koreaderISBNRegex.FindString(line); match != "" {
+				doc.ISBN = strings.ReplaceAll(match, "-", "")
+				break
+			}
+		}
+	}
+
+	docPath := luaString(sidecar, "doc_path")
+	if doc.Title == "" {
+		doc.Title = strings.TrimSuffix(filepath.Base(docPath), filepath.Ext(docPath))
+	}
+	if doc.Title == "" {
+		doc.Title = strings.TrimSuffix(filepath.Base(filepath.Dir(path)), ".sdr")
+	}
+
+	// the partial md5 survives the file being moved, the path is a fallback for old sidecars
+	docID := luaString(sidecar, "partial_md5_checksum")
+	if docID == "" {
+		docID = docPath
+	}
+	if docID == "" {
+		docID = path
+	}
+	doc.BookID = "koreader:" + docID
+
+	// KOReader >= 2024.07 keeps everything in `annotations`, older versions in `bookmarks`
+	entries := luaList(sidecar["annotations"])
+	legacy := len(entries) == 0
+	if legacy {
+		entries = luaList(sidecar["bookmarks"])
+	}
+
+	for _, entry := range entries {
+		highlight := ImportedHighlight{
+			Chapter:  luaString(entry, "chapter"),
+			Datetime: luaString(entry, "datetime"),
+		}
+
+		if legacy {
+			if highlighted, _ := entry["highlighted"].(bool); !highlighted {
+				continue
+			}
+			highlight.Text = luaString(entry, "notes")
+			// only keep text the user wrote, not the default note
+			if note := luaString(entry, "text"); note != "" && !isLegacyDefaultNote(note, highlight.Text) {
+				highlight.Note = note
+			}
+		} else {
+			highlight.Text = luaString(entry, "text")
+			highlight.Note = luaString(entry, "note")
+		}
+		if highlight.Text == "" {
+			continue
+		}
+
+		if page, ok := luaInt(entry, "pageno"); ok {
+			highlight.Page = page
+		} else if page, ok := luaInt(entry, "page"); ok {
+			highlight.Page = page
+		}
+
+		position := luaString(entry, "pos0")
+		if position == "" {
+			position = luaString(entry, "page")
+		}
+		sum := sha1.Sum([]byte(doc.BookID + "|" + position + "|" + highlight.Text))
+		highlight.BookmarkID = "koreader:" + hex.EncodeToString(sum[:])
+
+		doc.Highlights = append(doc.Highlights, highlight)
+	}
+
+	return doc
+}
+
+// isLegacyDefaultNote reports whether note is the text legacy KOReader generates for a highlight.
+func isLegacyDefaultNote(note string, highlight string) bool {
+	match := koreaderLegacyNoteRegex.FindStringSubmatch(strings.TrimSpace(note))
+	return match != nil && strings.TrimSpace(match[1]) == strings.TrimSpace(highlight)
+}
+
+// findKOReaderSidecars walks root for `*.sdr/metadata.*.lua` files.
+func findKOReaderSidecars(root string) []string {
+	var sidecars []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			slog.Warn("Skipping unreadable path", "path", path, "error", err)
+			return nil
+		}
+		if d.IsDir() && strings.HasPrefix(d.Name(), ".") && path != root && d.Name() != ".adds" {
+			// .kobo and friends never hold sidecars and can be large
+			return fs.SkipDir
+		}
+		if !d.IsDir() && koreaderSidecarRegex.MatchString(d.Name()) &&
+			strings.HasSuffix(filepath.Dir(path), ".sdr") {
+			sidecars = append(sidecars, path)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed to walk KOReader library for sidecars", "root", root, "error", err)
+	}
+	return sidecars
+}
+
+// koreaderSource imports highlights from KOReader sidecar files found under root.
+type koreaderSource struct {
+	root string
+}
+
+func (source koreaderSource) Name() string {
+	return "koreader"
+}
+
+// Populate parses every sidecar under root and stores its highlights.
+func (source koreaderSource) Populate() error {
+	if _, err := os.Stat(source.root); err != nil {
+		return fmt.Errorf("KOReader library %s is not readable: %w", source.root, err)
+	}
+
+	sidecars := findKOReaderSidecars(source.root)
+	slog.Info("Found KOReader sidecar files", "sidecars", len(sidecars), "root", source.root)
+
+	var books []ImportedBook
+	for _, path := range sidecars {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			slog.Warn("failed to read KOReader sidecar", "path", path, "error", err)
+			continue
+		}
+		sidecar, err := parseLuaTable(string(src))
+		if err != nil {
+			slog.Warn("failed to parse KOReader sidecar", "path", path, "error", err)
+			continue
+		}
+
+		books = append(books, newKOReaderBook(path, sidecar))
+	}
+
+	insertImportedBooks(source.Name(), books)
+	return nil
+}
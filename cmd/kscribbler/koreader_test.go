@@ -0,0 +1,179 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLuaTable(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want map[string]any
+	}{
+		{
+			name: "escaped quotes and newlines",
+			src:  `return { ["text"] = "She said \"no\"\nand left", ['note'] = 'it\'s \\ fine' }`,
+			want: map[string]any{"text": "She said \"no\"\nand left", "note": `it's \ fine`},
+		},
+		{
+			name: "escaped line break and decimal escapes",
+			src:  "return { [\"text\"] = \"first\\\nsecond\\9tab\\065\" }",
+			want: map[string]any{"text": "first\nsecond\ttabA"},
+		},
+		{
+			name: "nested tables with integer keys",
+			src: `-- we can read Lua syntax here!
+return {
+    ["annotations"] = {
+        [1] = {
+            ["pageno"] = 12,
+            ["text"] = "one",
+        },
+        [2] = {
+            ["pos0"] = "/body/DocFragment[3]",
+            ["text"] = "two",
+        },
+    },
+    ["percent_finished"] = 0.25,
+}`,
+			want: map[string]any{
+				"annotations": map[string]any{
+					"1": map[string]any{"pageno": int64(12), "text": "one"},
+					"2": map[string]any{"pos0": "/body/DocFragment[3]", "text": "two"},
+				},
+				"percent_finished": 0.25,
+			},
+		},
+		{
+			name: "implicit indexes, identifier keys and comments",
+			src:  "return { \"a\", --[[ block ]] \"b\"; name = true, [\"gone\"] = nil, -- trailing\n n = -3 }",
+			want: map[string]any{"1": "a", "2": "b", "name": true, "gone": nil, "n": int64(-3)},
+		},
+		{
+			name: "long string",
+			src:  "return { [\"text\"] = [[\nline \"one\"\nline two]] }",
+			want: map[string]any{"text": "line \"one\"\nline two"},
+		},
+		{
+			name: "utf-8 text",
+			src:  `return { ["text"] = "naïve café — “quoted”" }`,
+			want: map[string]any{"text": "naïve café — “quoted”"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLuaTable(tt.src)
+			if err != nil {
+				t.Fatalf("parseLuaTable() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLuaTable() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLuaTableErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"unterminated string", `return { ["text"] = "open }`},
+		{"unterminated table", `return { ["text"] = "a", `},
+		{"missing bracket", `return { ["text" = "a" }`},
+		{"not a table", `return "text"`},
+		{"empty", ``},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseLuaTable(tt.src); err == nil {
+				t.Errorf("parseLuaTable(%q) succeeded, want an error", tt.src)
+			}
+		})
+	}
+}
+
+func TestNewKOReaderBook(t *testing.T) {
+	tests := []struct {
+		name       string
+		src        string
+		wantTitle  string
+		wantISBN   string
+		wantTexts  []string
+		wantNotes  []string
+		wantPages  []int64
+		wantBookID string
+	}{
+		{
+			name: "annotations",
+			src: `return {
+    ["doc_path"] = "/mnt/onboard/Books/Some Book.epub",
+    ["partial_md5_checksum"] = "abc123",
+    ["doc_props"] = { ["title"] = "Some Book", ["identifiers"] = "uuid:1234\nISBN:978-0-306-40615-7" },
+    ["annotations"] = {
+        [2] = { ["text"] = "second", ["pageno"] = 20 },
+        [1] = { ["text"] = "first", ["note"] = "my note", ["pageno"] = 10 },
+        [3] = { ["text"] = "", ["note"] = "bookmark without text" },
+    },
+}`,
+			wantTitle:  "Some Book",
+			wantISBN:   "9780306406157",
+			wantTexts:  []string{"first", "second"},
+			wantNotes:  []string{"my note", ""},
+			wantPages:  []int64{10, 20},
+			wantBookID: "koreader:abc123",
+		},
+		{
+			name: "legacy bookmarks",
+			src: `return {
+    ["doc_path"] = "/mnt/onboard/Books/Old Book.epub",
+    ["bookmarks"] = {
+        [1] = { ["highlighted"] = true, ["notes"] = "highlighted text", ["text"] = "Page 4 highlighted text @ 2024-03-01 21:04:13", ["page"] = 4 },
+        [2] = { ["highlighted"] = true, ["notes"] = "with a note", ["text"] = "what I wrote", ["page"] = 5 },
+        [3] = { ["highlighted"] = false, ["notes"] = "a plain bookmark", ["page"] = 6 },
+        [4] = { ["highlighted"] = true, ["notes"] = "quoted", ["text"] = "I agree with quoted", ["page"] = 7 },
+        [5] = { ["highlighted"] = true, ["notes"] = "paged", ["text"] = "Page 8 paged", ["page"] = 8 },
+    },
+}`,
+			wantTitle:  "Old Book",
+			wantTexts:  []string{"highlighted text", "with a note", "quoted", "paged"},
+			wantNotes:  []string{"", "what I wrote", "I agree with quoted", ""},
+			wantPages:  []int64{4, 5, 7, 8},
+			wantBookID: "koreader:/mnt/onboard/Books/Old Book.epub",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sidecar, err := parseLuaTable(tt.src)
+			if err != nil {
+				t.Fatalf("parseLuaTable() error = %v", err)
+			}
+			book := newKOReaderBook("/mnt/onboard/Books/x.sdr/metadata.epub.lua", sidecar)
+
+			if book.Title != tt.wantTitle || book.ISBN != tt.wantISBN || book.BookID != tt.wantBookID {
+				t.Errorf("book = %q %q %q, want %q %q %q",
+					book.Title, book.ISBN, book.BookID, tt.wantTitle, tt.wantISBN, tt.wantBookID)
+			}
+
+			var texts, notes []string
+			var pages []int64
+			for _, h := range book.Highlights {
+				texts = append(texts, h.Text)
+				notes = append(notes, h.Note)
+				pages = append(pages, h.Page)
+				if !strings.HasPrefix(h.BookmarkID, "koreader:") {
+					t.Errorf("bookmark id %q does not start with koreader:", h.BookmarkID)
+				}
+			}
+			if !reflect.DeepEqual(texts, tt.wantTexts) || !reflect.DeepEqual(notes, tt.wantNotes) ||
+				!reflect.DeepEqual(pages, tt.wantPages) {
+				t.Errorf("highlights = %q %q %v, want %q %q %v", texts, notes, pages, tt.wantTexts, tt.wantNotes, tt.wantPages)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Values of LONG_ENTRIES: what happens to a journal entry longer than MAX_ENTRY_LENGTH.
+const (
+	// post it as several entries numbered (1/3), (2/3), ...
+	longEntriesSplit = "split"
+	// cut it at MAX_ENTRY_LENGTH and end it with an ellipsis
+	longEntriesTruncate = "truncate"
+	// leave it pending and record why
+	longEntriesSkip = "skip"
+)
+
+var longEntries = longEntriesSplit
+
+// maxEntryLength is the longest journal entry, in characters, kscribbler sends to Hardcover.
+var maxEntryLength = 5000
+
+// entryTooLong explains why the rendered entry is skipped with LONG_ENTRIES=skip, or is empty.
+func (entry Bookmark) entryTooLong() string {
+	if longEntries != longEntriesSkip {
+		return ""
+	}
+	text, _ := entry.journalEntry()
+	if length := utf8.RuneCountInString(text); length > maxEntryLength {
+		return fmt.Sprintf("entry is %d characters, longer than MAX_ENTRY_LENGTH (%d)", length, maxEntryLength)
+	}
+	return ""
+}
+
+// journalEntries renders the entry and applies LONG_ENTRIES, returning the texts to post in order and the event
+// type. Entries within MAX_ENTRY_LENGTH are a single text.
+func (entry Bookmark) journalEntries() ([]string, string) {
+	text, hardcoverType := entry.journalEntry()
+	if utf8.RuneCountInString(text) <= maxEntryLength {
+		return []string{text}, hardcoverType
+	}
+
+	switch longEntries {
+	case longEntriesTruncate:
+		return []string{truncateEntry(text, maxEntryLength)}, hardcoverType
+	case longEntriesSplit:
+		return splitEntry(text, maxEntryLength), hardcoverType
+	}
+	return []string{text}, hardcoverType
+}
+
+// truncateEntry cuts text to at most limit characters at a word boundary and marks the cut with an ellipsis.
+func truncateEntry(text string, limit int) string {
+	head, _ := cutEntry(text, limit-1)
+	return strings.TrimRight(head, " \n.,;:") + "…"
+}
+
+// splitEntry breaks text into parts of at most limit characters, each ending in its number, e.g. "(2/3)".
+// Parts are cut at a paragraph, sentence or word boundary when there is one.
+func splitEntry(text string, limit int) []string {
+	var parts []string
+	// leave room for the part number, starting from fewer than 100 parts and splitting again with smaller parts
+	// when there are more
+	for digits := 2; ; digits++ {
+		number := strings.Repeat("9", digits)
+		budget := limit - utf8.RuneCountInString("\n\n("+number+"/"+number+")")
+
+		parts = nil
+		for rest := text; rest != ""; {
+			var part string
+			part, rest = cutEntry(rest, budget)
+			parts = append(parts, part)
+		}
+		if len(strconv.Itoa(len(parts))) <= digits {
+			break
+		}
+	}
+
+	for i := range parts {
+		parts[i] = fmt.Sprintf("%s\n\n(%d/%d)", parts[i], i+1, len(parts))
+	}
+	slog.Debug("Split long journal entry", "parts", len(parts), "length", utf8.RuneCountInString(text))
+	return parts
+}
+
+// cutEntry returns the first at most limit characters of text and the remaining text. It cuts at the last
+// paragraph, sentence or word boundary in the second half of the limit, so parts are not cut into crumbs.
+func cutEntry(text string, limit int) (string, string) {
+	if utf8.RuneCountInString(text) <= limit {
+		return text, ""
+	}
+
+	// byte index of the first character past the limit
+	end, count := len(text), 0
+	for i := range text {
+		if count == limit {
+			end = i
+			break
+		}
+		count++
+	}
+
+	head := text[:end]
+	cut := end
+	for _, separator := range []string{"\n\n", ". ", "? ", "! ", "\n", " "} {
+		if i := strings.LastIndex(head, separator); i > 0 && utf8.RuneCountInString(head[:i]) >= limit/2 {
+			cut = i + len(strings.TrimRight(separator, " \n"))
+			break
+		}
+	}
+
+	return strings.TrimSpace(text[:cut]), strings.TrimSpace(text[cut:])
+}
+
+// markPartUploaded records that the first parts of a split entry were posted, so a retry does not repeat them.
+// Every bookmark merged into the entry shares the count.
+func (entry Bookmark) markPartUploaded(parts int) error {
+	query, args, err := sqlx.In(
+		`UPDATE quote SET uploaded_parts = ? WHERE bookmark_id IN (?);`,
+		parts,
+		entry.bookmarkIDs(),
+	)
+	if err == nil {
+		_, err = kscribblerDB.Exec(query, args...)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: failed to record uploaded parts of %s: %w", errNotRecorded, entry.BookmarkID, err)
+	}
+	return nil
+}
+
+// recordSkip stores why the entry was not uploaded so `kscribbler quotes` shows it. It does not count as an attempt,
+// and an unchanged reason is not written again on every sync.
+func (entry Bookmark) recordSkip(reason string) {
+	lastError := "skipped: " + reason
+	query, args, err := sqlx.In(
+		`UPDATE quote SET last_error = ? WHERE bookmark_id IN (?) AND last_error IS NOT ?;`,
+		lastError,
+		entry.bookmarkIDs(),
+		lastError,
+	)
+	if err == nil {
+		_, err = kscribblerDB.Exec(query, args...)
+	}
+	if err != nil {
+		slog.Error("failed to record skipped entry", "bookmark", entry.BookmarkID, "error", err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCutEntry(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		limit    int
+		wantHead string
+		wantRest string
+	}{
+		{"fits", "Short text.", 20, "Short text.", ""},
+		{"exactly the limit", "0123456789", 10, "0123456789", ""},
+		{"at a paragraph", "First paragraph.\n\nSecond one here.", 25, "First paragraph.", "Second one here."},
+		{"at a sentence", "One sentence. Another sentence.", 20, "One sentence.", "Another sentence."},
+		{"at a question", "Is it so? It is indeed so.", 15, "Is it so?", "It is indeed so."},
+		{"at a word", "several short words in a row", 12, "several", "short words in a row"},
+		{"boundary too early is ignored", "A. bcdefghijklmnopqrstuvwxyz", 10, "A. bcdefgh", "ijklmnopqrstuvwxyz"},
+		{"no boundary", "abcdefghijklmnopqrstuvwxyz", 10, "abcdefghij", "klmnopqrstuvwxyz"},
+		{"counts runes, not bytes", "ééééé ééééé ééééé", 12, "ééééé ééééé", "ééééé"},
+		{"multibyte without a boundary", "日本語の文章を切る", 4, "日本語の", "文章を切る"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, rest := cutEntry(tt.text, tt.limit)
+			if head != tt.wantHead || rest != tt.wantRest {
+				t.Errorf("cutEntry(%q, %d) = %q, %q, want %q, %q", tt.text, tt.limit, head, rest, tt.wantHead, tt.wantRest)
+			}
+			if n := utf8.RuneCountInString(head); n > tt.limit {
+				t.Errorf("head is %d characters, longer than %d", n, tt.limit)
+			}
+		})
+	}
+}
+
+func TestSplitEntry(t *testing.T) {
+	sentence := "This sentence is forty characters long. "
+	tests := []struct {
+		name      string
+		text      string
+		limit     int
+		wantParts int
+		// what the cuts between parts dropped
+		separator string
+	}{
+		{"two parts", strings.Repeat(sentence, 5), 150, 2, " "},
+		{"many parts", strings.Repeat(sentence, 30), 100, 15, " "},
+		{"multibyte", strings.Repeat("Ça coûte très cher, à peu près ça. ", 20), 120, 7, " "},
+		{"no boundaries", strings.Repeat("x", 250), 60, 5, ""},
+		{"more than 99 parts", strings.Repeat(sentence, 240), 100, 120, " "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := splitEntry(strings.TrimSpace(tt.text), tt.limit)
+			if len(parts) != tt.wantParts {
+				t.Fatalf("splitEntry() returned %d parts, want %d", len(parts), tt.wantParts)
+			}
+
+			var joined []string
+			for i, part := range parts {
+				if n := utf8.RuneCountInString(part); n > tt.limit {
+					t.Errorf("part %d is %d characters with its number, longer than %d", i+1, n, tt.limit)
+				}
+				suffix := fmt.Sprintf("\n\n(%d/%d)", i+1, len(parts))
+				if !strings.HasSuffix(part, suffix) {
+					t.Errorf("part %d = %q, want it to end in %q", i+1, part, suffix)
+				}
+				joined = append(joined, strings.TrimSuffix(part, suffix))
+			}
+
+			if got := strings.Join(joined, tt.separator); got != strings.TrimSpace(tt.text) {
+				t.Errorf("parts do not add up to the text:\n%q\nwant\n%q", got, strings.TrimSpace(tt.text))
+			}
+		})
+	}
+}
+
+func TestTruncateEntry(t *testing.T) {
+	tests := []struct {
+		text  string
+		limit int
+		want  string
+	}{
+		{"One sentence. Another sentence.", 20, "One sentence…"},
+		{"several short words in a row", 13, "several…"},
+		{"abcdefghijklmnopqrstuvwxyz", 10, "abcdefghi…"},
+		{"ééééé ééééé ééééé", 13, "ééééé ééééé…"},
+	}
+
+	for _, tt := range tests {
+		got := truncateEntry(tt.text, tt.limit)
+		if got != tt.want {
+			t.Errorf("truncateEntry(%q, %d) = %q, want %q", tt.text, tt.limit, got, tt.want)
+		}
+		if n := utf8.RuneCountInString(got); n > tt.limit {
+			t.Errorf("truncateEntry(%q, %d) is %d characters", tt.text, tt.limit, n)
+		}
+	}
+}
+
+func TestJournalEntries(t *testing.T) {
+	defer func(mode string, limit int) { longEntries, maxEntryLength = mode, limit }(longEntries, maxEntryLength)
+
+	entry := Bookmark{Type: "highlight"}
+	entry.Quote.String = strings.TrimSpace(strings.Repeat("This sentence is forty characters long. ", 5))
+	entry.Quote.Valid = true
+
+	tests := []struct {
+		mode      string
+		limit     int
+		wantParts int
+		wantSkip  bool
+	}{
+		{longEntriesSplit, 1000, 1, false},
+		{longEntriesSplit, 150, 2, false},
+		{longEntriesTruncate, 150, 1, false},
+		{longEntriesSkip, 150, 1, true},
+		{longEntriesSkip, 1000, 1, false},
+	}
+
+	for _, tt := range tests {
+		longEntries, maxEntryLength = tt.mode, tt.limit
+		parts, _ := entry.journalEntries()
+		if len(parts) != tt.wantParts {
+			t.Errorf("%s at %d: %d parts, want %d", tt.mode, tt.limit, len(parts), tt.wantParts)
+		}
+		if skip := entry.entryTooLong() != ""; skip != tt.wantSkip {
+			t.Errorf("%s at %d: skipped = %t, want %t", tt.mode, tt.limit, skip, tt.wantSkip)
+		}
+		if tt.mode != longEntriesSkip {
+			for _, part := range parts {
+				if n := utf8.RuneCountInString(part); n > tt.limit {
+					t.Errorf("%s at %d: part is %d characters", tt.mode, tt.limit, n)
+				}
+			}
+		}
+	}
+}
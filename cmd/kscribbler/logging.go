@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Logging configuration, set by loadConfig from KSCRIBBLER_DEBUG, LOG_FORMAT, LOG_FILE and LOG_MAX_SIZE.
+var debugLogging bool
+var logFormat = "text"
+var logFilePath string
+var logMaxSize int64 = 1 << 20
+
+// Rotated logs are kept as kscribbler.log.1 (newest) to kscribbler.log.3 (oldest).
+const logBackups = 3
+
+const redacted = "[REDACTED]"
+
+var bearerTokenRegex = regexp.MustCompile(`(?i)bearer\s+[^\s"']+`)
+
+// Attribute keys whose values are never written to the log.
+var sensitiveLogKeys = map[string]bool{
+	"authorization":       true,
+	"token":               true,
+	"hardcover_api_token": true,
+}
+
+// defaultLogFilePath is kscribbler.log next to config.env, when that directory exists (on the device).
+func defaultLogFilePath() string {
+	dir := filepath.Dir(configPath)
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		return filepath.Join(dir, "kscribbler.log")
+	}
+	return ""
+}
+
+// parseByteSize parses sizes such as "1048576", "512K" or "2M".
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier, s = 1<<10, strings.TrimSuffix(s, "K")
+	case strings.HasSuffix(s, "M"):
+		multiplier, s = 1<<20, strings.TrimSuffix(s, "M")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+// setupLogging installs the slog default logger. Records go to stderr and, when logFilePath is set, to a size
+// rotated log file.
+func setupLogging() {
+	level := slog.LevelInfo
+	if debugLogging {
+		level = slog.LevelDebug
+	}
+
+	var out io.Writer = os.Stderr
+	if logFilePath != "" {
+		out = io.MultiWriter(os.Stderr, &rotatingFile{path: logFilePath, maxSize: logMaxSize})
+	}
+
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	var handler slog.Handler
+	if strings.ToLower(logFormat) == "json" {
+		handler = slog.NewJSONHandler(out, options)
+	} else {
+		handler = slog.NewTextHandler(out, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// redactAttr hides the Hardcover token wherever it shows up: sensitive keys, the message and any string value.
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if sensitiveLogKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, redactSecrets(attr.Value.String()))
+	case slog.KindAny:
+		switch value := attr.Value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, redactSecrets(value.Error()))
+		case fmt.Stringer:
+			return slog.String(attr.Key, redactSecrets(value.String()))
+		}
+	}
+	return attr
+}
+
+func redactSecrets(s string) string {
+	// a placeholder token such as "x" would otherwise redact ordinary words
+	if len(authToken) >= 8 {
+		s = strings.ReplaceAll(s, authToken, redacted)
+	}
+	return bearerTokenRegex.ReplaceAllString(s, "Bearer "+redacted)
+}
+
+// fatal logs msg at error level and exits, the slog counterpart of log.Fatalf.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// rotatingFile appends to path and moves it aside once it would grow past maxSize.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// rotate shifts kscribbler.log.N to .N+1, dropping the oldest, and starts a new file.
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+
+	os.Remove(fmt.Sprintf("%s.%d", r.path, logBackups))
+	for i := logBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return r.open()
+}
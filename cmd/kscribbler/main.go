@@ -2,41 +2,58 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	_ "embed"
-	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/GianniBYoung/kscribbler/version"
+	"github.com/jmoiron/sqlx"
 	"github.com/joho/godotenv"
 	_ "modernc.org/sqlite"
 )
 
 var authToken string
-var stopAfterInit bool
-var markAllAsUploaded bool
-var showVersion bool
 var uploadAnnotations bool
 var privacySetting int
+var koreaderLibrary string
+var kindleClippingsPath string
+var calibreAnnotationsPath string
+
+var configPath = "/mnt/onboard/.adds/kscribbler/config.env"
+
+// Values of PAGE_NUMBERS: pages of the Kobo book, or rescaled to the matched Hardcover edition.
+const (
+	pageNumbersKobo    = "kobo"
+	pageNumbersEdition = "edition"
+)
+
+var pageNumbers = pageNumbersKobo
+
+// runTimeout bounds a whole sync so a stalled run ends before Nickel kills it.
+var runTimeout = 15 * time.Minute
+
+// errNotOnHardcover is returned by koboToHardcover when Hardcover has no edition with the book's ISBN.
+var errNotOnHardcover = errors.New("ISBN not found on Hardcover")
 
 // koboToHardcover fleshes out struct and assocites book to hardcover.
-func (book *Book) koboToHardcover() {
+func (book *Book) koboToHardcover(ctx context.Context, client *http.Client) error {
 	// TODO: Think about a more efficient query so i don't hammer the api
 
 	// this also assumes a valid isbn already
 	if book.SimpleISBN.ISBN10Number == "" && book.SimpleISBN.ISBN13Number == "" {
-		log.Printf("Book %s has no valid ISBN to query Hardcover", book.BookID)
-		return
+		slog.Warn("Book has no valid ISBN to query Hardcover", "book", book.BookID)
+		return nil
 	}
 
-	ctx := context.Background()
-	client := newHTTPClient()
-
 	var filters []string
 	if book.SimpleISBN.ISBN13Number != "" {
 		filters = append(
@@ -53,6 +70,8 @@ func (book *Book) koboToHardcover() {
 
 	orBlock := strings.Join(filters, ", ")
 
+	// besides the editions with the ISBN, ebook editions of the same books are candidates too. Those are fetched
+	// separately so the cap on them cannot drop an edition with the ISBN.
 	query := fmt.Sprintf(`
 		query findById {
 			books(
@@ -68,48 +87,42 @@ func (book *Book) koboToHardcover() {
 					where: {
 						_or: [%s]
 					}
-				) {
-					id
+					order_by: {id: asc}
+				) {%s
+				}
+				ebook_editions: editions(
+					where: {
+						reading_format: {format: {_eq: "Ebook"}}
+					}
+					order_by: {id: asc}
+					limit: 25
+				) {%s
 				}
 			}
-		}`, orBlock, orBlock)
-
-	// Build JSON payload
-	requestBody := map[string]string{"query": query}
-	bodyBytes, err := json.Marshal(requestBody)
-	if err != nil {
-		log.Fatalf("Failed to encode GraphQL request: %v", err)
-	}
+		}`, orBlock, orBlock, editionFields, editionFields)
 
-	req := newHardcoverRequest(ctx, bodyBytes)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatalf("Request failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	rawResp, _ := io.ReadAll(resp.Body)
 	var findBookResp Response
-	if err := json.Unmarshal(rawResp, &findBookResp); err != nil {
-		log.Println("Raw response:\n", string(rawResp))
-		log.Fatalf("Failed to unmarshal response: %v", err)
+	if err := postHardcoverQuery(client, ctx, query, nil, &findBookResp.Data); err != nil {
+		return err
 	}
-	fmt.Printf("Hardcover response: %+v\n", findBookResp)
 
-	if len(findBookResp.Data.Books) < 1 || len(findBookResp.Data.Books[0].Editions) < 1 {
-		log.Printf(
-			"Unable to ID Books from ISBN\nISBN10: %s\nISBN13: %s",
-			book.SimpleISBN.ISBN10Number,
-			book.SimpleISBN.ISBN13Number,
+	candidates := rankEditions(*book, findBookResp)
+	if len(candidates) == 0 {
+		slog.Warn(
+			"Unable to ID book from ISBN",
+			"isbn10", book.SimpleISBN.ISBN10Number,
+			"isbn13", book.SimpleISBN.ISBN13Number,
 		)
-	} else {
-
-		// set the hardcover info in the book struct for later use
-		book.HardcoverID = findBookResp.Data.Books[0].ID
-		book.HardcoverEdition = findBookResp.Data.Books[0].Editions[0].ID
+		return errNotOnHardcover
 	}
 
+	// set the hardcover info in the book struct for later use
+	book.HardcoverID = candidates[0].bookID
+	book.HardcoverEdition = candidates[0].edition.ID
+	book.EditionReason = sql.NullString{String: editionReason(candidates), Valid: true}
+	book.HardcoverPages = sql.NullInt64{Int64: int64(candidates[0].edition.Pages), Valid: candidates[0].edition.Pages > 0}
+	slog.Info("Chose Hardcover edition", "title", book.Title.String, "reason", book.EditionReason.String)
+	return nil
 }
 
 // hasBeenUploaded checks if the bookmark has already been uploaded to Hardcover by querying the kscribblerDB.
@@ -122,29 +135,80 @@ func (bm Bookmark) hasBeenUploaded() bool {
 		WHERE bookmark_id = ?
 	`, bm.BookmarkID)
 	if err != nil {
-		log.Printf("failed to check if bookmark has been uploaded: %v", err)
+		slog.Error("failed to check if bookmark has been uploaded", "error", err)
 		return true
 	}
 
 	return isUploaded != 0
 }
 
-// markAsUploaded updates the kscribblerDB to mark the quote as uploaded.
-func (bm Bookmark) markAsUploaded() {
-	log.Printf("Marking bookmark %s as uploaded", bm.BookmarkID)
-	_, err := kscribblerDB.Exec(`
+// errNotRecorded means an entry was posted but kscribblerDB could not record it. The sync stops rather than post
+// entries it cannot mark as uploaded, which the next sync would post again.
+var errNotRecorded = errors.New("could not record an upload")
+
+// errHardcoverUnreachable stops a sync before anything is posted.
+var errHardcoverUnreachable = errors.New("hardcover is not reachable")
+
+// markAsUploaded updates the kscribblerDB to mark the quote, and any quotes merged into it, as uploaded.
+func (bm Bookmark) markAsUploaded() error {
+	slog.Debug("Marking bookmark as uploaded", "bookmark", bm.BookmarkID)
+	query, args, err := sqlx.In(`
 		UPDATE quote
-		SET kscribbler_uploaded = 1
-		WHERE bookmark_id = ?;
-	`, bm.BookmarkID)
+		SET kscribbler_uploaded = 1, last_error = NULL, next_attempt_at = NULL
+		WHERE bookmark_id IN (?);
+	`, bm.bookmarkIDs())
+	if err == nil {
+		_, err = kscribblerDB.Exec(query, args...)
+	}
 
 	if err != nil {
-		log.Fatalf("failed to mark bookmark as uploaded: %v", err)
+		return fmt.Errorf("%w: failed to mark bookmark %s as uploaded: %w", errNotRecorded, bm.BookmarkID, err)
+	}
+	slog.Debug("Marked bookmark as uploaded", "bookmark", bm.BookmarkID)
+	return nil
+}
+
+// skipReason explains why the bookmark is not uploaded with the current configuration, or is empty.
+func (entry Bookmark) skipReason() string {
+	if entry.Type == "note" && !uploadAnnotations {
+		return "UPLOAD_ANNOTATIONS is not enabled"
 	}
-	log.Printf("Marked bookmark %s as uploaded", bm.BookmarkID)
+	return entry.entryTooLong()
+}
+
+// pageNumber is the page of the Kobo book or, with PAGE_NUMBERS=edition, of the Hardcover edition when its page
+// count is known. It is 0 when neither is known.
+func (entry Bookmark) pageNumber() int {
+	if pageNumbers == pageNumbersEdition && entry.Position.Valid &&
+		entry.EditionPages.Valid && entry.EditionPages.Int64 > 0 {
+		page := int(math.Round(entry.Position.Float64 * float64(entry.EditionPages.Int64)))
+		return max(page, 1)
+	}
+	if entry.Page.Valid && entry.Page.Int64 > 0 {
+		return int(entry.Page.Int64)
+	}
+	return 0
+}
+
+// pageLabel is the location that prefixes a journal entry. The edition mode of PAGE_NUMBERS falls back to the
+// percentage through the book when no page count is known.
+func (entry Bookmark) pageLabel() string {
+	if page := entry.pageNumber(); page > 0 {
+		return fmt.Sprintf("p. %d", page)
+	}
+	if pageNumbers == pageNumbersEdition && entry.Position.Valid {
+		return fmt.Sprintf("%d%%", int(math.Round(entry.Position.Float64*100)))
+	}
+	return ""
+}
+
+// journalEntry renders the reading journal text and event type, before LONG_ENTRIES is applied.
+func (entry Bookmark) journalEntry() (string, string) {
+	return entry.renderEntry(), "quote"
 }
 
-// postEntry uploads the bookmark (quote or annotation) to Hardcover using their GraphQL API.
+// postEntry uploads the bookmark (quote or annotation) to Hardcover using their GraphQL API. An entry split by
+// LONG_ENTRIES is posted part by part, and a retry continues after the parts that were already posted.
 func (entry Bookmark) postEntry(
 	client *http.Client,
 	ctx context.Context,
@@ -157,101 +221,132 @@ func (entry Bookmark) postEntry(
 		return nil
 	}
 
-	quote := strings.TrimSpace(entry.Quote.String)
-	annotation := strings.TrimSpace(entry.Annotation.String)
-
-	entryText := quote
-
-	hardcoverType := "quote"
-	if entry.Type == "note" {
-		if !uploadAnnotations {
-			log.Printf("Skipping annotation (UPLOAD_ANNOTATIONS is not enabled): %s", entry.BookmarkID)
-			return nil
+	entryTexts, hardcoverType := entry.journalEntries()
+	for part := entry.UploadedParts; part < len(entryTexts); part++ {
+		err := postJournalEntry(client, ctx, hardcoverID, hardcoverEdition, hardcoverType, spoiler, entryTexts[part])
+		if err != nil {
+			return err
+		}
+		if len(entryTexts) > 1 {
+			if err := entry.markPartUploaded(part + 1); err != nil {
+				return err
+			}
 		}
-		entryText = fmt.Sprintf("%s\n\n---\n\n%s", quote, annotation)
 	}
 
-	if entry.Page.Valid && entry.Page.Int64 > 0 {
-		entryText = fmt.Sprintf("p. %d\n\n%s", entry.Page.Int64, entryText)
-	}
+	// Only mark as uploaded if there were no errors
+	return entry.markAsUploaded()
+}
 
-	entryText = strings.ReplaceAll(entryText, `"""`, `\"\"\"`)
+// postJournalEntry sends a single reading journal entry to Hardcover.
+func postJournalEntry(
+	client *http.Client,
+	ctx context.Context,
+	hardcoverID int,
+	hardcoverEdition int,
+	hardcoverType string,
+	spoiler bool,
+	entryText string,
+) error {
+	// the entry is sent as a variable so quotes, backslashes and """ in the text need no escaping
 	mutation := fmt.Sprintf(`
-	mutation postquote {
+	mutation postquote($entry: String!) {
     insert_reading_journal(
-		object: {privacy_setting_id: %d, book_id: %d, edition_id: %d, event: "%s", tags: {spoiler: %t, category: "%s", tag: ""}, entry: """%s""" }
+		object: {privacy_setting_id: %d, book_id: %d, edition_id: %d, event: "%s", tags: {spoiler: %t, category: "%s", tag: ""}, entry: $entry }
      ) {
     errors
   }
 }`,
 		privacySetting, hardcoverID, hardcoverEdition, hardcoverType, spoiler,
-		hardcoverType, entryText)
-
-	reqBody := map[string]string{"query": mutation}
-	bodyBytes, _ := json.Marshal(reqBody)
-	req := newHardcoverRequest(ctx, bodyBytes)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Error with post response %s", err)
-		return err
-	}
-	defer resp.Body.Close()
-
-	rawResp, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return err
-	}
-	fmt.Println("Hardcover response:", string(rawResp))
+		hardcoverType)
 
-	// Parse the response to check for errors
 	var response Response
-	err = json.Unmarshal(rawResp, &response)
-	if err != nil {
-		log.Printf("Error unmarshaling response: %v", err)
+	variables := map[string]any{"entry": entryText}
+	if err := postHardcoverQuery(client, ctx, mutation, variables, &response.Data); err != nil {
 		return err
 	}
 
-	// Check for top-level GraphQL errors first
-	if len(response.Errors) > 0 {
-		log.Printf("Hardcover API returned GraphQL error: %s", response.Errors[0].Message)
-		return fmt.Errorf("hardcover GraphQL error: %s", response.Errors[0].Message)
-	}
-
 	// Check if there were errors from Hardcover API
 	if response.Data.InsertReadingJournal.Errors != nil &&
 		*response.Data.InsertReadingJournal.Errors != "" {
-		log.Printf("Hardcover API returned error: %s", *response.Data.InsertReadingJournal.Errors)
 		return fmt.Errorf("hardcover API error: %s", *response.Data.InsertReadingJournal.Errors)
 	}
 
-	// Only mark as uploaded if there were no errors
-	entry.markAsUploaded()
-
 	return nil
 }
 
-// Initializes the environment, database, and retrieves the last opened book and its bookmarks.
-func init() {
-	flag.BoolVar(&stopAfterInit, "init", false, "Stop execution after init() runs")
-	flag.BoolVar(
-		&markAllAsUploaded,
-		"mark-all-as-uploaded",
-		false,
-		"Mark all quotes in the database as uploaded (useful for migration)",
-	)
-	flag.BoolVar(&showVersion, "version", false, "Show version information and exit")
-	flag.Parse()
-	if showVersion {
-		fmt.Printf("v%s", version.Version)
-		os.Exit(0)
+// loadConfig reads config.env and the environment into the package configuration.
+func loadConfig() {
+	godotenv.Load(configPath)
+	authToken = os.Getenv("HARDCOVER_API_TOKEN")
+
+	debugLogging = strings.ToLower(os.Getenv("KSCRIBBLER_DEBUG")) == "true"
+	if format := os.Getenv("LOG_FORMAT"); format != "" {
+		logFormat = format
+	}
+	logFilePath = defaultLogFilePath()
+	if path, ok := os.LookupEnv("LOG_FILE"); ok {
+		logFilePath = path
+	}
+	if size, err := parseByteSize(os.Getenv("LOG_MAX_SIZE")); err == nil && size > 0 {
+		logMaxSize = size
 	}
-	log.Printf("Starting Kscribbler v%s\n", version.Version)
+	setupLogging()
 
-	godotenv.Load("/mnt/onboard/.adds/kscribbler/config.env")
-	authToken = os.Getenv("HARDCOVER_API_TOKEN")
 	uploadAnnotations = strings.ToLower(os.Getenv("UPLOAD_ANNOTATIONS")) == "true"
+	mergeHighlights = strings.ToLower(os.Getenv("MERGE_HIGHLIGHTS")) == "true"
+	uploadDogears = strings.ToLower(os.Getenv("UPLOAD_DOGEARS")) == "true"
+	uploadMarkups = strings.ToLower(os.Getenv("UPLOAD_MARKUPS")) == "true"
+	syncProgress = strings.ToLower(os.Getenv("SYNC_PROGRESS")) == "true"
+	progressAddBooks = strings.ToLower(os.Getenv("SYNC_PROGRESS_ADD_BOOKS")) == "true"
+	koreaderLibrary = os.Getenv("KOREADER_LIBRARY")
+	kindleClippingsPath = os.Getenv("KINDLE_CLIPPINGS")
+	calibreAnnotationsPath = os.Getenv("CALIBRE_ANNOTATIONS")
+	syncExcludePatterns = parseSyncPatterns(os.Getenv("SYNC_EXCLUDE"))
+
+	if attempts, err := strconv.Atoi(os.Getenv("MAX_UPLOAD_ATTEMPTS")); err == nil && attempts > 0 {
+		maxUploadAttempts = attempts
+	}
+	if rpm, err := strconv.Atoi(os.Getenv("HARDCOVER_REQUESTS_PER_MINUTE")); err == nil && rpm > 0 {
+		requestsPerMinute = rpm
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("REQUEST_TIMEOUT")); err == nil && timeout > 0 {
+		requestTimeout = timeout
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("SYNC_TIMEOUT")); err == nil && timeout > 0 {
+		runTimeout = timeout
+	}
+	if wait, err := time.ParseDuration(os.Getenv("NETWORK_WAIT")); err == nil && wait >= 0 {
+		networkWait = wait
+	}
+	enableWifi = strings.ToLower(os.Getenv("ENABLE_WIFI")) == "true"
+	switch setting := strings.ToLower(os.Getenv("PAGE_NUMBERS")); setting {
+	case pageNumbersKobo, pageNumbersEdition:
+		pageNumbers = setting
+	case "":
+	default:
+		slog.Warn("Unknown PAGE_NUMBERS, using kobo", "value", setting)
+	}
+	switch setting := strings.ToLower(os.Getenv("LONG_ENTRIES")); setting {
+	case longEntriesSplit, longEntriesTruncate, longEntriesSkip:
+		longEntries = setting
+	case "":
+	default:
+		slog.Warn("Unknown LONG_ENTRIES, splitting long entries", "value", setting)
+	}
+	if length, err := strconv.Atoi(os.Getenv("MAX_ENTRY_LENGTH")); err == nil && length >= 100 {
+		maxEntryLength = length
+	}
+	switch setting := strings.ToLower(os.Getenv("SMART_QUOTES")); setting {
+	case smartQuotesKeep, smartQuotesStraight, smartQuotesCurly:
+		smartQuotes = setting
+	case "":
+	default:
+		slog.Warn("Unknown SMART_QUOTES, keeping quotes as they are", "value", setting)
+	}
+	if setting := os.Getenv("NOTIFIER"); setting != "" {
+		notifierSetting = setting
+	}
 
 	privacySetting = 1
 	switch strings.ToLower(os.Getenv("PRIVACY")) {
@@ -260,65 +355,114 @@ func init() {
 	case "private":
 		privacySetting = 3
 	}
-	if authToken == "" {
-		log.Fatalf(
-			"HARDCOVER_API_TOKEN is not set.\nPlease set it in /mnt/onboard/.kobo/.adds/kscribbler/config.env\n",
-		)
-	}
 
 	if devDBPath := os.Getenv("KSCRIBBLER_DB_PATH"); devDBPath != "" {
 		koboDBPath = devDBPath + "/KoboReader.sqlite"
 		kscribblerDBPath = devDBPath + "/kscribbler.sqlite"
 	}
+}
+
+// requireAuthToken exits when no Hardcover token is configured.
+func requireAuthToken() {
+	if authToken == "" {
+		fatal("HARDCOVER_API_TOKEN is not set, please set it in config.env", "config", configPath)
+	}
+}
 
-	// create kscribblerDB and populate it with relevant data from KoboReader.sqlite
+// populateDatabase creates kscribblerDB and fills it from the configured sources. It does not touch the network.
+func populateDatabase() {
+	// create kscribblerDB and populate it from KoboReader.sqlite and any other configured highlight sources
 	createKscribblerTables()
-	populateBookTable()
-	populateQuoteTable()
+	migrateKscribblerTables()
+	populateFromSources()
 
-	// Supplement book entries with ISBNs and Hardcover info
 	kscribblerDB = connectKscribblerDB()
-	syncISBNsFromKoboDB()
+	normalizeQuotes(kscribblerDB)
 	updateDBWithISBNs()
-	updateDBWithHardcoverInfo()
 	kscribblerDB.Close()
-
-	log.Println("kscribblerDB initialized. Ready to upload quotes")
 }
 
-func main() {
-	if stopAfterInit {
-		log.Println(
-			"The init flag was set; stopping execution after database initialization. Quotes will not be uploaded.",
-		)
-		os.Exit(0)
+// prepareDatabase populates kscribblerDB and resolves missing Hardcover IDs, for every book or only bookID.
+// It fails when the network does not come up in time.
+func prepareDatabase(ctx context.Context, bookID string) error {
+	requireAuthToken()
+	populateDatabase()
+
+	if err := waitForNetwork(ctx); err != nil {
+		return fmt.Errorf("network is not available, nothing was uploaded: %w", err)
 	}
 
-	if markAllAsUploaded {
-		log.Println(
-			"The mark-all-as-uploaded flag was set; marking all quotes in kscribblerDB as uploaded. Quotes will not be uploaded.",
-		)
-		kscribblerDB = connectKscribblerDB()
-		_, err := kscribblerDB.Exec(` UPDATE quote SET kscribbler_uploaded = 1;`)
+	// Supplement book entries with Hardcover info
+	kscribblerDB = connectKscribblerDB()
+	updateDBWithHardcoverInfo(ctx, bookID)
+	kscribblerDB.Close()
 
-		if err != nil {
-			log.Fatalf("failed to mark all quotes as uploaded in kscribblerDB: %v", err)
-		}
-		log.Println("All quotes marked as uploaded. Exiting.")
-		os.Exit(0)
+	slog.Info("kscribblerDB initialized. Ready to upload quotes")
+	return nil
+}
+
+// newRunContext returns the context of a command that talks to Hardcover. It is cancelled by SIGINT/SIGTERM
+// (Nickel stopping the process, Ctrl-C on desktop) and when runTimeout has passed.
+func newRunContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithTimeout(ctx, runTimeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// interruptionReason describes why ctx ended a run early.
+func interruptionReason(ctx context.Context) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Sprintf("SYNC_TIMEOUT of %s reached", runTimeout)
+	}
+	if cause := context.Cause(ctx); errors.Is(cause, errHardcoverUnreachable) || errors.Is(cause, errNotRecorded) {
+		return cause.Error()
 	}
+	return "interrupted"
+}
+
+// uploadPendingQuotes posts every pending quote of every matched book, or only of bookID, to Hardcover.
+// It stops between requests once ctx is done, Hardcover cannot be reached or an upload cannot be recorded, and
+// returns what was done either way.
+func uploadPendingQuotes(ctx context.Context, bookID string) SyncSummary {
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
 
-	ctx := context.Background()
 	client := newHTTPClient()
-	verifyHardcoverConnection(client, ctx)
+	if err := checkHardcoverConnection(client, ctx); err != nil {
+		slog.Error("Hardcover is not reachable", "error", err)
+		stop(errHardcoverUnreachable)
+	}
 
 	kscribblerDB = connectKscribblerDB()
 	defer kscribblerDB.Close()
-	books := loadBooksFromDB()
+	books := loadBooksFromDB(bookID)
+
+	summary := SyncSummary{Unmatched: reportUnmatchedBooks(bookID)}
+	for _, currentBook := range books {
+		summary.Pending += len(currentBook.Bookmarks) + len(currentBook.Markers)
+	}
 
 	for _, currentBook := range books {
-		log.Printf("Processing book: %s\n", currentBook)
+		if ctx.Err() != nil {
+			break
+		}
+		slog.Info("Processing book", "title", currentBook.Title.String, "book", currentBook.BookID)
+		uploadedToBook := false
 		for _, bm := range currentBook.Bookmarks {
+			if ctx.Err() != nil {
+				break
+			}
+			if reason := bm.skipReason(); reason != "" {
+				slog.Info("Skipping entry", "type", bm.Type, "reason", reason, "bookmark", bm.BookmarkID)
+				bm.recordSkip(reason)
+				summary.Skipped++
+				summary.Pending--
+				continue
+			}
+
 			err := bm.postEntry(
 				client,
 				ctx,
@@ -327,13 +471,130 @@ func main() {
 				false,
 			)
 
+			if errors.Is(err, errNotRecorded) {
+				slog.Error("Stopping the sync", "bookmark", bm.BookmarkID, "error", err)
+				stop(errNotRecorded)
+				break
+			}
+			if err != nil && ctx.Err() != nil {
+				// the run was cut short, not the quote's fault: leave it pending without counting an attempt
+				slog.Warn("Upload cancelled", "bookmark", bm.BookmarkID, "error", err)
+				break
+			}
+
+			summary.Pending--
+			recordUploadEvent(bm, currentBook, err)
+			if err != nil {
+				slog.Error("failed to upload quote to reading journal", "bookmark", bm.BookmarkID, "error", err)
+				bm.recordFailure(err)
+				summary.Failed++
+			} else {
+				slog.Info("Uploaded bookmark", "bookmark", bm.BookmarkID)
+				summary.Uploaded++
+				uploadedToBook = true
+			}
+		}
+		for _, marker := range currentBook.Markers {
+			if ctx.Err() != nil {
+				break
+			}
+
+			err := marker.postMarker(client, ctx, currentBook)
+			if errors.Is(err, errNotRecorded) {
+				slog.Error("Stopping the sync", "bookmark", marker.BookmarkID, "error", err)
+				stop(errNotRecorded)
+				break
+			}
+			if err != nil && ctx.Err() != nil {
+				slog.Warn("Upload cancelled", "bookmark", marker.BookmarkID, "error", err)
+				break
+			}
+
+			summary.Pending--
+			recordUploadEvent(marker.asBookmark(), currentBook, err)
 			if err != nil {
-				log.Printf("There was an error uploading quote to reading journal: %s\n", err)
+				slog.Error("failed to upload marker to reading journal", "type", marker.Type, "bookmark", marker.BookmarkID, "error", err)
+				marker.recordFailure(err)
+				summary.Failed++
 			} else {
-				log.Printf("Uploaded bookmark: %s\n", bm.BookmarkID)
+				slog.Info("Uploaded marker", "type", marker.Type, "bookmark", marker.BookmarkID)
+				summary.Markers++
+				uploadedToBook = true
+			}
+		}
+		if uploadedToBook {
+			summary.Books++
+		}
+		slog.Info("Finished uploading bookmarks for book", "title", currentBook.Title.String)
+	}
+
+	if ctx.Err() != nil {
+		summary.Interrupted = interruptionReason(ctx)
+	}
+	slog.Info(summary.String())
+	return summary
+}
+
+// printPendingQuotes shows what uploadPendingQuotes would post without sending anything or marking quotes.
+func printPendingQuotes(bookID string) {
+	kscribblerDB = connectKscribblerDB()
+	defer kscribblerDB.Close()
+	books := loadBooksFromDB(bookID)
+
+	posted, skipped := 0, 0
+	for _, currentBook := range books {
+		fmt.Printf(
+			"\n===== %s =====\nHardcover book: %d  edition: %d  privacy: %s\n",
+			currentBook.Title.String,
+			currentBook.HardcoverID,
+			currentBook.HardcoverEdition,
+			privacyName(privacySetting),
+		)
+
+		for _, bm := range currentBook.Bookmarks {
+			if reason := bm.skipReason(); reason != "" {
+				fmt.Printf("\n--- %s: skipped (%s) ---\n", bm.BookmarkID, reason)
+				skipped++
+				continue
 			}
+
+			entryTexts, hardcoverType := bm.journalEntries()
+			for _, entryText := range entryTexts {
+				fmt.Printf("\n--- %s: %s ---\n%s\n", strings.Join(bm.bookmarkIDs(), " + "), hardcoverType, entryText)
+				posted++
+			}
+		}
+
+		for _, marker := range currentBook.Markers {
+			entryText, hardcoverType := marker.journalEntry()
+			fmt.Printf("\n--- %s: %s (%s) ---\n%s\n", marker.BookmarkID, hardcoverType, marker.Type, entryText)
+			posted++
 		}
-		log.Printf("Finished uploading bookmarks for book: %s\n", currentBook.Title.String)
 	}
-	log.Println("Job done!")
+
+	fmt.Printf(
+		"\nDry run: %d entries would be posted to %d books, %d skipped. Nothing was sent to Hardcover.\n",
+		posted,
+		len(books),
+		skipped,
+	)
+	if unmatched := reportUnmatchedBooks(bookID); unmatched > 0 {
+		fmt.Printf("%d books have no Hardcover match and were left out, see `kscribbler unmatched`.\n", unmatched)
+	}
+}
+
+// privacyName returns the PRIVACY config value for a Hardcover privacy_setting_id.
+func privacyName(setting int) string {
+	switch setting {
+	case 2:
+		return "followers"
+	case 3:
+		return "private"
+	}
+	return "public"
+}
+
+func main() {
+	loadConfig()
+	os.Exit(runCommand(os.Args[1:]))
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// kscrib: directives in notes are instructions to kscribbler, not part of the note.
+var directiveRegex = regexp.MustCompile(`(?i)kscrib:\S*`)
+
+// markdownItem is a highlight, dogear or markup in reading order.
+type markdownItem struct {
+	position  float64
+	createdAt string
+	text      string
+}
+
+// loadExportQuotes loads every quote of a book, uploaded or not.
+func loadExportQuotes(bookID string) []Bookmark {
+	var quotes []Bookmark
+	err := kscribblerDB.Select(&quotes, `
+		SELECT
+			bookmark_id,
+			book_id,
+			quote,
+			annotation,
+			page,
+			position,
+			(SELECT b.hardcover_pages FROM book b WHERE b.book_id = q.book_id) AS edition_pages,
+			chapter,
+			created_at,
+			type
+		FROM quote q
+		WHERE book_id = ?;
+	`, bookID)
+	if err != nil {
+		fatal("failed to load quotes for export", "book", bookID, "error", err)
+	}
+	return quotes
+}
+
+// markdown renders the quote as a block quote followed by the note and where it is in the book.
+func (entry Bookmark) markdown() string {
+	var block strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(entry.Quote.String), "\n") {
+		block.WriteString(strings.TrimRight("> "+line, " ") + "\n")
+	}
+
+	if note := strings.TrimSpace(directiveRegex.ReplaceAllString(entry.Annotation.String, "")); note != "" {
+		block.WriteString("\n" + note + "\n")
+	}
+
+	var location []string
+	if label := entry.pageLabel(); label != "" {
+		location = append(location, label)
+	}
+	if chapter := strings.TrimSpace(entry.Chapter.String); chapter != "" {
+		location = append(location, chapter)
+	}
+	if len(location) > 0 {
+		block.WriteString("\n*" + strings.Join(location, ", ") + "*\n")
+	}
+	return block.String()
+}
+
+// markdown renders the marker as a line in italics, with the drawing of a markup linked below it.
+func (m Marker) markdown() string {
+	text, _ := m.journalEntry()
+	block := "*" + text + "*\n"
+	if m.MarkupFile.Valid {
+		block += fmt.Sprintf("\n![%s](%s)\n", text, m.MarkupFile.String)
+	}
+	return block
+}
+
+// exportMarkdown writes every book's highlights, notes, dogears and markups in reading order to outputPath.
+func exportMarkdown(outputPath string) {
+	var books []Book
+	err := kscribblerDB.Select(&books, `
+		SELECT b.book_id, b.book_title
+		FROM book b
+		WHERE EXISTS (SELECT 1 FROM quote q WHERE q.book_id = b.book_id)
+		OR EXISTS (SELECT 1 FROM marker m WHERE m.book_id = b.book_id)
+		ORDER BY b.book_title, b.book_id;
+	`)
+	if err != nil {
+		fatal("failed to load books for export", "error", err)
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		fatal("failed to create markdown export", "path", outputPath, "error", err)
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+
+	items := 0
+	fmt.Fprintln(w, "# Kscribbler highlights")
+	for _, book := range books {
+		var bookItems []markdownItem
+		for _, quote := range loadExportQuotes(book.BookID) {
+			if strings.TrimSpace(quote.Quote.String) == "" {
+				continue
+			}
+			bookItems = append(bookItems, markdownItem{quote.Position.Float64, quote.CreatedAt.String, quote.markdown()})
+		}
+		for _, marker := range loadMarkers(book.BookID, false) {
+			bookItems = append(bookItems, markdownItem{marker.Position.Float64, marker.CreatedAt.String, marker.markdown()})
+		}
+		slices.SortStableFunc(bookItems, func(a, b markdownItem) int {
+			return cmp.Or(cmp.Compare(a.position, b.position), cmp.Compare(a.createdAt, b.createdAt))
+		})
+
+		fmt.Fprintf(w, "\n## %s\n", book.Title.String)
+		for _, item := range bookItems {
+			fmt.Fprintf(w, "\n%s", item.text)
+		}
+		items += len(bookItems)
+	}
+
+	if err := w.Flush(); err != nil {
+		fatal("failed to write markdown export", "path", outputPath, "error", err)
+	}
+	slog.Info("Exported highlights to markdown", "books", len(books), "entries", items, "path", outputPath)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Kobo bookmarks without highlighted text: dogears (page bookmarks) and handwritten markups drawn with a stylus on
+// the Sage and Elipsa, whose drawing is kept in .kobo/markups/<bookmark id>.svg and .jpg.
+const (
+	markerDogear = "dogear"
+	markerMarkup = "markup"
+)
+
+// Hardcover journal event for markers: both dogears and markups are posted as notes pointing at their page.
+const markerEvent = "note"
+
+var uploadDogears bool
+var uploadMarkups bool
+
+// createMarkerTable creates the table of dogears and markups if it does not exist.
+func createMarkerTable(db *sqlx.DB) {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS marker (
+		bookmark_id TEXT PRIMARY KEY NOT NULL,
+		book_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		chapter TEXT,
+		position REAL,
+		page INTEGER,
+		created_at TEXT,
+		markup_file TEXT,
+		kscribbler_uploaded INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(book_id) REFERENCES book(book_id)
+	)
+`)
+	if err != nil {
+		fatal("failed to create marker table in kscribblerDB", "error", err)
+	}
+}
+
+// populateMarkerTable copies dogears and markups from KoboReader.sqlite. Markers are imported whether or not they
+// are uploaded so exports include them.
+func populateMarkerTable() {
+	kscribblerDB := connectDatabases()
+	defer kscribblerDB.Close()
+
+	slog.Info("Populating marker table")
+	_, err := kscribblerDB.Exec(`
+		INSERT OR IGNORE INTO marker(bookmark_id, book_id, type, chapter, created_at)
+		SELECT b.BookmarkID, b.VolumeID, b.Type, c.Title, b.DateCreated
+		FROM koboDB.Bookmark b
+		JOIN koboDB.content c ON b.ContentID = c.ContentID
+		WHERE b.Type IN (?, ?)
+		AND (b.Text IS NULL OR TRIM(b.Text) = '');
+	`, markerDogear, markerMarkup)
+	if err != nil {
+		fatal("failed to populate marker table", "error", err)
+	}
+
+	// like quotes, pending markers follow the book when its position or page count changes
+	updateQuery := positionUpdateQuery(
+		kscribblerDB,
+		"marker",
+		"marker.position IS NULL OR marker.kscribbler_uploaded = 0",
+	)
+	if _, err := kscribblerDB.Exec(updateQuery); err != nil {
+		slog.Error("failed to sync marker positions", "error", err)
+	}
+
+	_, err = kscribblerDB.Exec(`
+		UPDATE marker
+		SET page = (
+			SELECT CAST(ROUND(marker.position * sp.StorePages) AS INTEGER)
+			FROM koboDB.content sp
+			WHERE sp.ContentID = marker.book_id
+			AND sp.StorePages > 0
+		)
+		WHERE marker.position IS NOT NULL
+		AND (marker.page IS NULL OR marker.kscribbler_uploaded = 0)
+		AND EXISTS (
+			SELECT 1 FROM koboDB.content sp
+			WHERE sp.ContentID = marker.book_id
+			AND sp.StorePages > 0
+		);
+	`)
+	if err != nil {
+		slog.Error("failed to sync marker page numbers", "error", err)
+	}
+
+	syncMarkupFiles(kscribblerDB)
+}
+
+// syncMarkupFiles records the drawing of each markup, preferring the SVG Nickel renders from over the JPG preview.
+func syncMarkupFiles(kscribblerDB *sqlx.DB) {
+	var bookmarkIDs []string
+	err := kscribblerDB.Select(
+		&bookmarkIDs,
+		`SELECT bookmark_id FROM marker WHERE type = ? AND markup_file IS NULL;`,
+		markerMarkup,
+	)
+	if err != nil {
+		slog.Error("failed to load markups", "error", err)
+		return
+	}
+
+	markupDir := filepath.Join(filepath.Dir(koboDBPath), "markups")
+	for _, bookmarkID := range bookmarkIDs {
+		for _, extension := range []string{".svg", ".jpg"} {
+			path := filepath.Join(markupDir, bookmarkID+extension)
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			_, err := kscribblerDB.Exec(`UPDATE marker SET markup_file = ? WHERE bookmark_id = ?;`, path, bookmarkID)
+			if err != nil {
+				slog.Error("failed to record markup file", "bookmark", bookmarkID, "error", err)
+			}
+			break
+		}
+	}
+}
+
+// uploadedMarkerTypes lists the marker types UPLOAD_DOGEARS and UPLOAD_MARKUPS enable.
+func uploadedMarkerTypes() []string {
+	var types []string
+	if uploadDogears {
+		types = append(types, markerDogear)
+	}
+	if uploadMarkups {
+		types = append(types, markerMarkup)
+	}
+	return types
+}
+
+// pendingMarkerFilter is a SQL condition on the marker table alias selecting markers due for an upload attempt.
+// Failed markers wait for their retry like quotes do.
+func pendingMarkerFilter(alias string) string {
+	types := uploadedMarkerTypes()
+	if len(types) == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%s AND %s.type IN ('%s')", readyQuoteFilter(alias), alias, strings.Join(types, "', '"))
+}
+
+// loadMarkers loads the markers of a book, only those waiting to be uploaded when pendingOnly is set.
+func loadMarkers(bookID string, pendingOnly bool) []Marker {
+	filter := "1"
+	if pendingOnly {
+		filter = pendingMarkerFilter("m")
+	}
+
+	var markers []Marker
+	err := kscribblerDB.Select(&markers, `
+		SELECT
+			m.bookmark_id,
+			m.book_id,
+			m.type,
+			m.chapter,
+			m.position,
+			m.page,
+			(SELECT b.hardcover_pages FROM book b WHERE b.book_id = m.book_id) AS edition_pages,
+			m.created_at,
+			m.markup_file,
+			m.kscribbler_uploaded,
+			m.attempts
+		FROM marker m
+		WHERE m.book_id = ? AND `+filter+`
+		ORDER BY m.position, m.created_at;
+	`, bookID)
+	if err != nil {
+		fatal("failed to load markers for book", "book", bookID, "error", err)
+	}
+	return markers
+}
+
+// location describes where the marker is, e.g. "on p. 42 in Chapter 3", with pages following PAGE_NUMBERS.
+func (m Marker) location() string {
+	var parts []string
+	if label := (Bookmark{Page: m.Page, Position: m.Position, EditionPages: m.EditionPages}).pageLabel(); label != "" {
+		parts = append(parts, "on "+label)
+	}
+	if chapter := strings.TrimSpace(m.Chapter.String); chapter != "" {
+		parts = append(parts, "in "+chapter)
+	}
+	return strings.Join(parts, " ")
+}
+
+// journalEntry renders the reading journal text and event type of the marker.
+func (m Marker) journalEntry() (string, string) {
+	text := "Bookmarked"
+	if m.Type == markerMarkup {
+		text = "Handwritten markup"
+	}
+	if location := m.location(); location != "" {
+		text += " " + location
+	}
+	return text, markerEvent
+}
+
+// postMarker uploads the marker as a journal entry. A failed marker is retried after a delay, see recordFailure.
+func (m Marker) postMarker(client *http.Client, ctx context.Context, book Book) error {
+	entryText, hardcoverType := m.journalEntry()
+	err := postJournalEntry(client, ctx, book.HardcoverID, book.HardcoverEdition, hardcoverType, false, entryText)
+	if err != nil {
+		return err
+	}
+
+	_, err = kscribblerDB.Exec(
+		`UPDATE marker SET kscribbler_uploaded = 1, last_error = NULL, next_attempt_at = NULL WHERE bookmark_id = ?;`,
+		m.BookmarkID,
+	)
+	if err != nil {
+		return fmt.Errorf("%w: failed to mark marker %s as uploaded: %w", errNotRecorded, m.BookmarkID, err)
+	}
+	return nil
+}
+
+// asBookmark lets upload history record a marker like a quote.
+func (m Marker) asBookmark() Bookmark {
+	return Bookmark{BookmarkID: m.BookmarkID, BookID: m.BookID, Type: m.Type}
+}
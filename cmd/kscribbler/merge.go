@@ -0,0 +1,199 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MERGE_HIGHLIGHTS: combine highlights that continue each other, e.g. across a page turn, into one journal entry.
+var mergeHighlights bool
+
+// Kobo wraps every sentence of a kepub in a span with the id kobo.<paragraph>.<sentence>, escaped as
+// kobo\.5\.2 in Bookmark.StartContainerPath and EndContainerPath.
+var koboSpanRegex = regexp.MustCompile(`kobo\\?\.(\d+)\\?\.(\d+)`)
+
+// Overlapping highlights repeat text; shorter common runs are more likely a coincidence than an overlap.
+const minTextOverlap = 4
+
+// rangePoint is a character position inside a Kobo sentence span.
+type rangePoint struct {
+	paragraph int
+	sentence  int
+	offset    int
+}
+
+func compareRangePoints(a rangePoint, b rangePoint) int {
+	return cmp.Or(cmp.Compare(a.paragraph, b.paragraph), cmp.Compare(a.sentence, b.sentence), cmp.Compare(a.offset, b.offset))
+}
+
+// parseRangePoint reads the span and offset of a container path, using the innermost kobo span of the path.
+func parseRangePoint(path string, offset int64) (rangePoint, bool) {
+	matches := koboSpanRegex.FindAllStringSubmatch(path, -1)
+	if len(matches) == 0 {
+		return rangePoint{}, false
+	}
+	span := matches[len(matches)-1]
+	paragraph, err := strconv.Atoi(span[1])
+	if err != nil {
+		return rangePoint{}, false
+	}
+	sentence, err := strconv.Atoi(span[2])
+	if err != nil {
+		return rangePoint{}, false
+	}
+	return rangePoint{paragraph: paragraph, sentence: sentence, offset: int(offset)}, true
+}
+
+// highlightRange returns where a Nickel highlight starts and ends, if it was recorded.
+func (bm Bookmark) highlightRange() (rangePoint, rangePoint, bool) {
+	if !bm.ContentID.Valid || !bm.StartPath.Valid || !bm.EndPath.Valid {
+		return rangePoint{}, rangePoint{}, false
+	}
+	start, ok := parseRangePoint(bm.StartPath.String, bm.StartOffset.Int64)
+	if !ok {
+		return rangePoint{}, rangePoint{}, false
+	}
+	end, ok := parseRangePoint(bm.EndPath.String, bm.EndOffset.Int64)
+	if !ok {
+		return rangePoint{}, rangePoint{}, false
+	}
+	return start, end, true
+}
+
+// bookmarkIDs lists the bookmark and every bookmark merged into it.
+func (bm Bookmark) bookmarkIDs() []string {
+	return append([]string{bm.BookmarkID}, bm.MergedIDs...)
+}
+
+// continues reports whether a highlight starting at next touches or overlaps one ending at end: it starts before
+// end, right after it (allowing for the space between two words), or at the beginning of the following sentence.
+func continues(end rangePoint, next rangePoint) bool {
+	if next.paragraph == end.paragraph && next.sentence == end.sentence {
+		return next.offset <= end.offset+1
+	}
+	if compareRangePoints(next, end) < 0 {
+		return true
+	}
+	if next.offset != 0 {
+		return false
+	}
+	return (next.paragraph == end.paragraph && next.sentence == end.sentence+1) ||
+		(next.paragraph == end.paragraph+1 && next.sentence <= 1)
+}
+
+// joinHighlightText appends next to text, dropping the part of next that repeats the end of text.
+func joinHighlightText(text string, next string) string {
+	if strings.Contains(text, next) {
+		return text
+	}
+	for overlap := min(len(text), len(next)); overlap >= minTextOverlap; overlap-- {
+		if strings.HasSuffix(text, next[:overlap]) {
+			return text + next[overlap:]
+		}
+	}
+	return text + " " + next
+}
+
+// mergeAdjacentHighlights combines consecutive highlights of the same chapter whose ranges touch or overlap.
+// Notes are left alone. The merged entry takes the place of the earliest highlight and lists the others in
+// MergedIDs, so uploading it settles all of them.
+func mergeAdjacentHighlights(bookmarks []Bookmark) []Bookmark {
+	type rangedHighlight struct {
+		index      int
+		start, end rangePoint
+	}
+
+	var highlights []rangedHighlight
+	for i, bm := range bookmarks {
+		if bm.Type != "highlight" || strings.TrimSpace(bm.Annotation.String) != "" {
+			continue
+		}
+		if start, end, ok := bm.highlightRange(); ok {
+			highlights = append(highlights, rangedHighlight{index: i, start: start, end: end})
+		}
+	}
+	slices.SortFunc(highlights, func(a, b rangedHighlight) int {
+		return cmp.Or(
+			cmp.Compare(bookmarks[a.index].ContentID.String, bookmarks[b.index].ContentID.String),
+			compareRangePoints(a.start, b.start),
+		)
+	})
+
+	merged := make(map[int]Bookmark)
+	mergedAway := make(map[int]bool)
+	for i := 0; i < len(highlights); {
+		first := highlights[i]
+		entry := bookmarks[first.index]
+		end := first.end
+		placement := first.index
+
+		j := i + 1
+		for ; j < len(highlights); j++ {
+			next := highlights[j]
+			nextEntry := bookmarks[next.index]
+			if nextEntry.ContentID.String != entry.ContentID.String || !continues(end, next.start) {
+				break
+			}
+
+			entry.Quote.String = joinHighlightText(
+				strings.TrimSpace(entry.Quote.String),
+				strings.TrimSpace(nextEntry.Quote.String),
+			)
+			entry.MergedIDs = append(entry.MergedIDs, nextEntry.bookmarkIDs()...)
+			entry.Attempts = max(entry.Attempts, nextEntry.Attempts)
+			if compareRangePoints(next.end, end) > 0 {
+				end = next.end
+			}
+			mergedAway[next.index] = true
+			placement = min(placement, next.index)
+		}
+
+		if j > i+1 {
+			slog.Debug("Merged adjacent highlights", "bookmarks", entry.bookmarkIDs())
+			mergedAway[first.index] = true
+			merged[placement] = entry
+		}
+		i = j
+	}
+
+	if len(merged) == 0 {
+		return bookmarks
+	}
+
+	result := make([]Bookmark, 0, len(bookmarks))
+	for i, bm := range bookmarks {
+		if entry, ok := merged[i]; ok {
+			result = append(result, entry)
+		} else if !mergedAway[i] {
+			result = append(result, bm)
+		}
+	}
+	return result
+}
+
+// syncHighlightRanges copies the chapter and container range of Nickel highlights from KoboReader.sqlite, which
+// mergeAdjacentHighlights needs to find highlights that continue each other.
+func syncHighlightRanges(kscribblerDB *sqlx.DB) {
+	_, err := kscribblerDB.Exec(`
+		UPDATE quote
+		SET
+			content_id = b.ContentID,
+			start_path = b.StartContainerPath,
+			start_offset = b.StartOffset,
+			end_path = b.EndContainerPath,
+			end_offset = b.EndOffset
+		FROM koboDB.Bookmark b
+		WHERE b.BookmarkID = quote.bookmark_id
+		AND quote.source = 'nickel'
+		AND quote.content_id IS NULL;
+	`)
+	if err != nil {
+		slog.Error("failed to sync highlight ranges", "error", err)
+	}
+}
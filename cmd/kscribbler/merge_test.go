@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestParseRangePoint(t *testing.T) {
+	tests := []struct {
+		path   string
+		offset int64
+		want   rangePoint
+		wantOK bool
+	}{
+		{`span#kobo\.5\.2`, 7, rangePoint{5, 2, 7}, true},
+		{`span#kobo.12.1`, 0, rangePoint{12, 1, 0}, true},
+		{`div#kobo\.1\.1 > span#kobo\.3\.4`, 2, rangePoint{3, 4, 2}, true},
+		{`span#chapter1`, 2, rangePoint{}, false},
+		{``, 0, rangePoint{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseRangePoint(tt.path, tt.offset)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("parseRangePoint(%q, %d) = %v, %t, want %v, %t", tt.path, tt.offset, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestContinues(t *testing.T) {
+	tests := []struct {
+		name string
+		end  rangePoint
+		next rangePoint
+		want bool
+	}{
+		{"same sentence, right after", rangePoint{5, 2, 10}, rangePoint{5, 2, 10}, true},
+		{"same sentence, after a space", rangePoint{5, 2, 10}, rangePoint{5, 2, 11}, true},
+		{"same sentence, overlapping", rangePoint{5, 2, 10}, rangePoint{5, 2, 3}, true},
+		{"same sentence, a word apart", rangePoint{5, 2, 10}, rangePoint{5, 2, 16}, false},
+		{"starts in an earlier sentence", rangePoint{5, 2, 10}, rangePoint{5, 1, 40}, true},
+		{"start of the next sentence", rangePoint{5, 2, 10}, rangePoint{5, 3, 0}, true},
+		{"inside the next sentence", rangePoint{5, 2, 10}, rangePoint{5, 3, 4}, false},
+		{"sentence after next", rangePoint{5, 2, 10}, rangePoint{5, 4, 0}, false},
+		{"first sentence of the next paragraph", rangePoint{5, 2, 10}, rangePoint{6, 1, 0}, true},
+		{"next paragraph counted from 0", rangePoint{5, 2, 10}, rangePoint{6, 0, 0}, true},
+		{"second sentence of the next paragraph", rangePoint{5, 2, 10}, rangePoint{6, 2, 0}, false},
+		{"paragraph after next", rangePoint{5, 2, 10}, rangePoint{7, 1, 0}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := continues(tt.end, tt.next); got != tt.want {
+				t.Errorf("continues(%v, %v) = %t, want %t", tt.end, tt.next, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJoinHighlightText(t *testing.T) {
+	tests := []struct {
+		text string
+		next string
+		want string
+	}{
+		{"The first half", "and the second.", "The first half and the second."},
+		{"The first half and", "half and the second.", "The first half and the second."},
+		{"The whole sentence.", "whole", "The whole sentence."},
+		{"Ends with a", "a word", "Ends with a a word"},
+	}
+
+	for _, tt := range tests {
+		if got := joinHighlightText(tt.text, tt.next); got != tt.want {
+			t.Errorf("joinHighlightText(%q, %q) = %q, want %q", tt.text, tt.next, got, tt.want)
+		}
+	}
+}
+
+func TestMergeAdjacentHighlights(t *testing.T) {
+	str := func(s string) sql.NullString { return sql.NullString{String: s, Valid: true} }
+	highlight := func(id string, content string, start string, startOffset int64, end string, endOffset int64, text string) Bookmark {
+		return Bookmark{
+			BookmarkID:  id,
+			Type:        "highlight",
+			Quote:       str(text),
+			ContentID:   str(content),
+			StartPath:   str(`span#kobo\.` + start),
+			StartOffset: sql.NullInt64{Int64: startOffset, Valid: true},
+			EndPath:     str(`span#kobo\.` + end),
+			EndOffset:   sql.NullInt64{Int64: endOffset, Valid: true},
+		}
+	}
+	withNote := func(bm Bookmark, note string) Bookmark {
+		bm.Type = "note"
+		bm.Annotation = str(note)
+		return bm
+	}
+	withAttempts := func(bm Bookmark, attempts int) Bookmark {
+		bm.Attempts = attempts
+		return bm
+	}
+
+	tests := []struct {
+		name         string
+		bookmarks    []Bookmark
+		wantIDs      [][]string
+		wantQuotes   []string
+		wantAttempts []int
+	}{
+		{
+			name: "across a page turn",
+			bookmarks: []Bookmark{
+				highlight("a", "ch1", `1\.1`, 0, `1\.1`, 20, "The first half"),
+				highlight("b", "ch1", `1\.1`, 21, `1\.2`, 5, "and the second."),
+			},
+			wantIDs:    [][]string{{"a", "b"}},
+			wantQuotes: []string{"The first half and the second."},
+		},
+		{
+			name: "out of order and overlapping",
+			bookmarks: []Bookmark{
+				highlight("b", "ch1", `1\.1`, 10, `1\.2`, 5, "half and the second."),
+				highlight("a", "ch1", `1\.1`, 0, `1\.1`, 18, "The first half and"),
+			},
+			wantIDs:    [][]string{{"a", "b"}},
+			wantQuotes: []string{"The first half and the second."},
+		},
+		{
+			name: "chain of three in the following sentences",
+			bookmarks: []Bookmark{
+				highlight("a", "ch1", `1\.1`, 0, `1\.1`, 9, "One."),
+				highlight("b", "ch1", `1\.2`, 0, `1\.2`, 9, "Two."),
+				highlight("c", "ch1", `2\.1`, 0, `2\.1`, 9, "Three."),
+			},
+			wantIDs:    [][]string{{"a", "b", "c"}},
+			wantQuotes: []string{"One. Two. Three."},
+		},
+		{
+			name: "apart, in another chapter or with a note",
+			bookmarks: []Bookmark{
+				highlight("a", "ch1", `1\.1`, 0, `1\.1`, 9, "One."),
+				highlight("b", "ch1", `1\.3`, 0, `1\.3`, 9, "Three."),
+				highlight("c", "ch2", `1\.4`, 0, `1\.4`, 9, "Other chapter."),
+				withNote(highlight("d", "ch1", `1\.3`, 10, `1\.3`, 20, "Noted."), "a note"),
+			},
+			wantIDs:    [][]string{{"a"}, {"b"}, {"c"}, {"d"}},
+			wantQuotes: []string{"One.", "Three.", "Other chapter.", "Noted."},
+		},
+		{
+			name: "without a range",
+			bookmarks: []Bookmark{
+				highlight("a", "ch1", `1\.1`, 0, `1\.1`, 9, "One."),
+				{BookmarkID: "b", Type: "highlight", Quote: str("Imported.")},
+			},
+			wantIDs:    [][]string{{"a"}, {"b"}},
+			wantQuotes: []string{"One.", "Imported."},
+		},
+		{
+			name: "merged entry takes the place of the earliest",
+			bookmarks: []Bookmark{
+				highlight("x", "ch0", `1\.1`, 0, `1\.1`, 9, "Before."),
+				withAttempts(highlight("b", "ch1", `1\.2`, 0, `1\.2`, 9, "Two."), 3),
+				highlight("a", "ch1", `1\.1`, 0, `1\.1`, 9, "One."),
+			},
+			wantIDs:      [][]string{{"x"}, {"a", "b"}},
+			wantQuotes:   []string{"Before.", "One. Two."},
+			wantAttempts: []int{0, 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ids [][]string
+			var quotes []string
+			var attempts []int
+			for _, bm := range mergeAdjacentHighlights(tt.bookmarks) {
+				ids = append(ids, bm.bookmarkIDs())
+				quotes = append(quotes, bm.Quote.String)
+				attempts = append(attempts, bm.Attempts)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("bookmark ids = %q, want %q", ids, tt.wantIDs)
+			}
+			if !reflect.DeepEqual(quotes, tt.wantQuotes) {
+				t.Errorf("quotes = %q, want %q", quotes, tt.wantQuotes)
+			}
+			if tt.wantAttempts != nil && !reflect.DeepEqual(attempts, tt.wantAttempts) {
+				t.Errorf("attempts = %v, want %v", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os/exec"
+	"time"
+)
+
+// networkWait is how long a sync waits for the Hardcover API to become reachable, e.g. while Wi-Fi is still
+// associating after the device wakes up.
+var networkWait = 60 * time.Second
+
+// enableWifi asks Nickel to connect to Wi-Fi over D-Bus when the API is not reachable. Needs NickelDBus.
+var enableWifi bool
+
+const networkPollInterval = 2 * time.Second
+const networkProbeTimeout = 5 * time.Second
+
+// waitForNetwork blocks until the Hardcover API host resolves and accepts TCP connections, networkWait has
+// passed, or ctx is done.
+func waitForNetwork(ctx context.Context) error {
+	api, err := url.Parse(apiURL)
+	if err != nil {
+		return fmt.Errorf("invalid API url %s: %w", apiURL, err)
+	}
+	host := api.Hostname()
+	address := net.JoinHostPort(host, "443")
+
+	deadline := time.Now().Add(networkWait)
+	askedForWifi := false
+	for {
+		err := probeHost(ctx, host, address)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if enableWifi && !askedForWifi {
+			askedForWifi = true
+			requestWifi(ctx)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s is not reachable after waiting %s: %w", host, networkWait, err)
+		}
+
+		slog.Info("Waiting for network", "error", err)
+		if err := sleepContext(ctx, networkPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// probeHost resolves host and opens a TCP connection to address.
+func probeHost(ctx context.Context, host string, address string) error {
+	ctx, cancel := context.WithTimeout(ctx, networkProbeTimeout)
+	defer cancel()
+
+	if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		return fmt.Errorf("DNS lookup failed: %w", err)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("connection failed: %w", err)
+	}
+	conn.Close()
+	return nil
+}
+
+// requestWifi asks Nickel to connect to a known Wi-Fi network, through the qndb helper when it is installed and
+// through dbus-send otherwise. Both go through NickelDBus; failures are logged and waiting continues.
+func requestWifi(ctx context.Context) {
+	var cmd *exec.Cmd
+	if path, err := exec.LookPath("qndb"); err == nil {
+		cmd = exec.CommandContext(ctx, path, "-m", "wfmConnectWirelessSilently")
+	} else {
+		cmd = exec.CommandContext(
+			ctx,
+			"dbus-send",
+			"--system",
+			"--print-reply",
+			"--dest=com.github.shermp.nickeldbus",
+			"/nickeldbus",
+			"com.github.shermp.nickeldbus.wfmConnectWirelessSilently",
+		)
+	}
+
+	slog.Info("Asking Nickel to connect to Wi-Fi")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		slog.Warn("Unable to ask Nickel for Wi-Fi (is NickelDBus installed?)", "error", err, "output", string(output))
+	}
+}
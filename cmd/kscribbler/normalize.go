@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Values of SMART_QUOTES: leave quotes as the book has them, or make them all straight or all curly.
+const (
+	smartQuotesKeep     = "keep"
+	smartQuotesStraight = "straight"
+	smartQuotesCurly    = "curly"
+)
+
+var smartQuotes = smartQuotesKeep
+
+// Invisible characters left in highlights by EPUB typesetting, and ligatures some books use as single glyphs.
+var highlightCleaner = strings.NewReplacer(
+	"\u00ad", "", // soft hyphen
+	"\u200b", "", // zero width space
+	"\u2060", "", // word joiner
+	"\ufeff", "", // byte order mark
+	"\u00a0", " ",
+	"\ufb00", "ff",
+	"\ufb01", "fi",
+	"\ufb02", "fl",
+	"\ufb03", "ffi",
+	"\ufb04", "ffl",
+	"\ufb05", "st",
+	"\ufb06", "st",
+)
+
+// a word hyphenated by the typesetter across a line break, e.g. "some\u00ad\nthing"
+var softHyphenBreakRegex = regexp.MustCompile(`\x{00ad}\s*\n\s*`)
+
+// a hyphenated word that happens to end a line, e.g. "well-\nknown", which keeps its hyphen
+var lineBreakHyphenRegex = regexp.MustCompile(`(\p{L}[-\x{2010}])\s*\n\s*(\p{Ll})`)
+var paragraphBreakRegex = regexp.MustCompile(`\s*\n\s*\n\s*`)
+var inlineWhitespaceRegex = regexp.MustCompile(`[^\S\n]*\n[^\S\n]*|[^\S\n]{2,}`)
+
+// fragments of the previous or next sentence caught at the edges of a highlight, e.g. ". The" or "end, (". En and
+// em dashes are left alone since they open dialogue ("— Hello") and end interrupted sentences ("But I —").
+var leadingFragmentRegex = regexp.MustCompile(`^[,.;:)\]}-]+\s+`)
+var trailingFragmentRegex = regexp.MustCompile(`(\s+[(\[{-]+|[,;:])+$`)
+
+// normalizeHighlight cleans up highlight text as it is stored: NFC, invisible characters and ligatures, words
+// hyphenated across lines, stray line breaks inside a paragraph and punctuation left over from the neighbouring
+// sentences. Only soft hyphens are dropped when joining a word across a line break, since a real hyphen at the
+// end of a line belongs to the word.
+func normalizeHighlight(text string) string {
+	text = norm.NFC.String(text)
+	text = softHyphenBreakRegex.ReplaceAllString(text, "")
+	text = highlightCleaner.Replace(text)
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = lineBreakHyphenRegex.ReplaceAllString(text, "$1$2")
+
+	paragraphs := paragraphBreakRegex.Split(strings.TrimSpace(text), -1)
+	for i, paragraph := range paragraphs {
+		paragraphs[i] = inlineWhitespaceRegex.ReplaceAllString(paragraph, " ")
+	}
+	text = strings.Join(paragraphs, "\n\n")
+
+	text = leadingFragmentRegex.ReplaceAllString(text, "")
+	text = trailingFragmentRegex.ReplaceAllString(text, "")
+	return strings.TrimSpace(text)
+}
+
+var straightQuoteReplacer = strings.NewReplacer(
+	"‘", "'", "’", "'", "‚", "'", "‛", "'",
+	"“", `"`, "”", `"`, "„", `"`, "‟", `"`,
+)
+
+// convertQuotes applies SMART_QUOTES to text when a journal entry is rendered.
+func convertQuotes(text string) string {
+	switch smartQuotes {
+	case smartQuotesStraight:
+		return straightQuoteReplacer.Replace(text)
+	case smartQuotesCurly:
+		return curlyQuotes(straightQuoteReplacer.Replace(text))
+	}
+	return text
+}
+
+// Words commonly written with a leading apostrophe for the letters left out, e.g. 'Tis.
+var elidedWords = map[string]bool{
+	"tis": true, "twas": true, "twere": true, "twill": true, "twould": true, "em": true, "cause": true,
+	"cos": true, "til": true, "bout": true, "round": true, "neath": true, "gainst": true,
+}
+
+// curlyQuotes turns straight quotes into opening or closing curly quotes depending on the character before them.
+// An apostrophe inside a word, or standing for left out letters or digits as in 'Tis and '90s, becomes a closing
+// single quote.
+func curlyQuotes(text string) string {
+	var out strings.Builder
+	runes := []rune(text)
+	previous := ' '
+	for i, r := range runes {
+		opening := unicode.IsSpace(previous) || strings.ContainsRune("([{—–", previous)
+		switch {
+		case r == '"' && opening:
+			out.WriteRune('“')
+		case r == '"':
+			out.WriteRune('”')
+		case r == '\'' && opening && !leadingApostrophe(runes[i+1:]):
+			out.WriteRune('‘')
+		case r == '\'':
+			out.WriteRune('’')
+		default:
+			out.WriteRune(r)
+		}
+		previous = r
+	}
+	return out.String()
+}
+
+// leadingApostrophe reports whether a single quote at the start of a word followed by rest is an apostrophe: it
+// comes before a digit or an elided word that is not itself closed by a single quote.
+func leadingApostrophe(rest []rune) bool {
+	if len(rest) > 0 && unicode.IsDigit(rest[0]) {
+		return true
+	}
+	end := 0
+	for end < len(rest) && unicode.IsLetter(rest[end]) {
+		end++
+	}
+	if end < len(rest) && rest[end] == '\'' {
+		return false
+	}
+	return elidedWords[strings.ToLower(string(rest[:end]))]
+}
+
+// normalizeQuotes normalizes pending quotes that have not been normalized yet, keeping the original text in
+// raw_quote. Uploaded quotes keep the text they were posted with. A quote that normalizes to the text of another
+// quote of the same book is a duplicate: it keeps its text and is marked as uploaded, as the import would have
+// skipped it had the texts matched. Keeping the row stops the next import from inserting it again.
+func normalizeQuotes(db *sqlx.DB) {
+	var quotes []Bookmark
+	err := db.Select(
+		&quotes,
+		`SELECT bookmark_id, book_id, quote FROM quote WHERE raw_quote IS NULL AND kscribbler_uploaded = 0;`,
+	)
+	if err != nil {
+		slog.Error("failed to load quotes to normalize", "error", err)
+		return
+	}
+
+	for _, q := range quotes {
+		normalized := normalizeHighlight(q.Quote.String)
+		if normalized == "" {
+			normalized = strings.TrimSpace(q.Quote.String)
+		}
+
+		var original string
+		err := db.Get(
+			&original,
+			`SELECT bookmark_id FROM quote WHERE quote = ? AND book_id = ? AND bookmark_id != ? LIMIT 1;`,
+			normalized,
+			q.BookID,
+			q.BookmarkID,
+		)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("failed to check for duplicate quotes", "bookmark", q.BookmarkID, "error", err)
+			continue
+		}
+		if original != "" {
+			slog.Info("Skipping duplicate quote", "bookmark", q.BookmarkID, "book", q.BookID, "duplicate_of", original)
+			_, err := db.Exec(
+				`UPDATE quote SET raw_quote = quote, kscribbler_uploaded = 1, last_error = ? WHERE bookmark_id = ?;`,
+				"duplicate of "+original,
+				q.BookmarkID,
+			)
+			if err != nil {
+				slog.Error("failed to mark duplicate quote", "bookmark", q.BookmarkID, "error", err)
+			}
+			continue
+		}
+
+		// quote texts are unique across books, so a quote that normalizes to another book's quote keeps its text
+		var taken int
+		err = db.Get(&taken, `SELECT COUNT(*) FROM quote WHERE quote = ? AND bookmark_id != ?;`, normalized, q.BookmarkID)
+		if err != nil {
+			slog.Error("failed to check for duplicate quotes", "bookmark", q.BookmarkID, "error", err)
+			continue
+		}
+		if taken > 0 {
+			slog.Info("Keeping quote unnormalized, another book has the same text", "bookmark", q.BookmarkID)
+			normalized = q.Quote.String
+		}
+
+		_, err = db.Exec(
+			`UPDATE quote SET raw_quote = quote, quote = ? WHERE bookmark_id = ?;`,
+			normalized,
+			q.BookmarkID,
+		)
+		if err != nil {
+			slog.Error("failed to normalize quote", "bookmark", q.BookmarkID, "error", err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestNormalizeHighlight(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain text", "A sentence.", "A sentence."},
+		{"surrounding whitespace", "  \n A sentence. \n ", "A sentence."},
+		{"soft hyphen across a line break", "some\u00ad\nthing", "something"},
+		{"soft hyphen inside a line", "hy\u00adphen", "hyphen"},
+		{"hyphen at the end of a line is kept", "a well-\nknown fact", "a well-known fact"},
+		{"unicode hyphen at the end of a line is kept", "a well\u2010\nknown fact", "a well\u2010known fact"},
+		{"hyphen before a capital is not joined", "the east-\nWest line", "the east- West line"},
+		{"line break inside a paragraph", "first line\nsecond line", "first line second line"},
+		{"paragraphs are kept", "first paragraph\n \n\nsecond  paragraph", "first paragraph\n\nsecond paragraph"},
+		{"crlf", "first\r\n\r\nsecond", "first\n\nsecond"},
+		{"invisible characters", "\ufeffzero\u200bwidth\u2060joined", "zerowidthjoined"},
+		{"no-break space", "ten\u00a0pages", "ten pages"},
+		{"ligatures", "ﬁne ﬂower", "fine flower"},
+		{"nfc", "cafe\u0301", "café"},
+		{"leading fragment", ". The next sentence", "The next sentence"},
+		{"leading dash", "- and then it ended", "and then it ended"},
+		{"dialogue dash is kept", "— Hello, he said", "— Hello, he said"},
+		{"interrupted sentence is kept", "But I —", "But I —"},
+		{"dash inside the text is kept", "it ended - finally", "it ended - finally"},
+		{"trailing fragment", "The end, (", "The end"},
+		{"trailing comma", "one, two,", "one, two"},
+		{"trailing dash", "and then -", "and then"},
+		{"closing punctuation is kept", "(Really.)", "(Really.)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeHighlight(tt.text); got != tt.want {
+				t.Errorf("normalizeHighlight(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertQuotes(t *testing.T) {
+	tests := []struct {
+		mode string
+		text string
+		want string
+	}{
+		{smartQuotesKeep, `“Mixed" 'quotes’`, `“Mixed" 'quotes’`},
+		{smartQuotesStraight, `“Don’t,” she said, ‘please.’`, `"Don't," she said, 'please.'`},
+		{smartQuotesCurly, `"Don't," she said, 'please.'`, `“Don’t,” she said, ‘please.’`},
+		{smartQuotesCurly, `("quoted") —"dashed"`, `(“quoted”) —“dashed”`},
+		{smartQuotesCurly, `'Tis the season`, `’Tis the season`},
+		{smartQuotesCurly, `back in the '90s`, `back in the ’90s`},
+		{smartQuotesCurly, `he said 'round' twice`, `he said ‘round’ twice`},
+		{smartQuotesCurly, `'twas brillig`, `’twas brillig`},
+		{smartQuotesCurly, `the dogs' bones`, `the dogs’ bones`},
+	}
+
+	defer func(mode string) { smartQuotes = mode }(smartQuotes)
+	for _, tt := range tests {
+		smartQuotes = tt.mode
+		if got := convertQuotes(tt.text); got != tt.want {
+			t.Errorf("convertQuotes(%q) with %s = %q, want %q", tt.text, tt.mode, got, tt.want)
+		}
+	}
+}
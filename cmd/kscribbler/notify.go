@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Notifier shows a short message to the person holding the device.
+type Notifier interface {
+	Notify(message string) error
+}
+
+// notifierSetting selects the notifier: auto, nickeldbus, fbink or none.
+var notifierSetting = "auto"
+
+// FBInk ships with KFMon and NickelMenu setups in one of these places when it is not on PATH.
+var fbinkPaths = []string{"/usr/local/kfmon/bin/fbink", "/mnt/onboard/.adds/kfmon/bin/fbink"}
+
+const notifyTimeout = 10 * time.Second
+
+// nickelDBusNotifier shows a Nickel toast through NickelDBus' qndb helper.
+type nickelDBusNotifier struct {
+	qndb string
+}
+
+func (n nickelDBusNotifier) Notify(message string) error {
+	return runNotifyCommand(n.qndb, "-m", "mwcToast", "5000", "Kscribbler", message)
+}
+
+// fbinkNotifier prints the message directly on the framebuffer.
+type fbinkNotifier struct {
+	fbink string
+}
+
+func (n fbinkNotifier) Notify(message string) error {
+	return runNotifyCommand(n.fbink, "-q", "-p", "-m", "-y", "-5", "Kscribbler: "+message)
+}
+
+// noopNotifier is used on desktops and when notifications are turned off.
+type noopNotifier struct{}
+
+func (noopNotifier) Notify(message string) error {
+	return nil
+}
+
+func runNotifyCommand(name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// lookupFBInk finds the fbink binary on PATH or in its usual install locations.
+func lookupFBInk() (string, bool) {
+	if path, err := exec.LookPath("fbink"); err == nil {
+		return path, true
+	}
+	for _, path := range fbinkPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// newNotifier picks the notifier from NOTIFIER. auto prefers a Nickel toast, falls back to FBInk and does nothing
+// when neither is installed.
+func newNotifier() Notifier {
+	qndb, qndbErr := exec.LookPath("qndb")
+	fbink, hasFBInk := lookupFBInk()
+
+	switch strings.ToLower(notifierSetting) {
+	case "none", "off", "false":
+		return noopNotifier{}
+	case "nickeldbus":
+		if qndbErr == nil {
+			return nickelDBusNotifier{qndb: qndb}
+		}
+		slog.Warn("NOTIFIER is nickeldbus but qndb was not found, notifications are off")
+		return noopNotifier{}
+	case "fbink":
+		if hasFBInk {
+			return fbinkNotifier{fbink: fbink}
+		}
+		slog.Warn("NOTIFIER is fbink but fbink was not found, notifications are off")
+		return noopNotifier{}
+	}
+
+	switch {
+	case qndbErr == nil:
+		return nickelDBusNotifier{qndb: qndb}
+	case hasFBInk:
+		return fbinkNotifier{fbink: fbink}
+	}
+	return noopNotifier{}
+}
+
+// notify shows message with the configured notifier, logging instead of failing when it cannot.
+func notify(message string) {
+	if err := newNotifier().Notify(message); err != nil {
+		slog.Warn("failed to show notification", "error", err)
+	}
+}
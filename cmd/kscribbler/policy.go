@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Sync policies of a book. "ask" books are left out of a full sync and only uploaded when the book is picked
+// explicitly with `sync --current` or `sync --book`.
+const (
+	syncPolicyAlways = "always"
+	syncPolicyNever  = "never"
+	syncPolicyAsk    = "ask"
+)
+
+const noSyncDirective = "kscrib:nosync"
+
+// syncExcludePatterns are the SYNC_EXCLUDE globs matched against book titles and paths.
+var syncExcludePatterns []*regexp.Regexp
+
+// parseSyncPatterns compiles a comma separated list of case-insensitive globs where `*` matches anything.
+func parseSyncPatterns(list string) []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, glob := range strings.Split(list, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		expr := regexp.QuoteMeta(glob)
+		expr = strings.ReplaceAll(expr, `\*`, `.*`)
+		expr = strings.ReplaceAll(expr, `\?`, `.`)
+		patterns = append(patterns, regexp.MustCompile(`(?i)^`+expr+`$`))
+	}
+	return patterns
+}
+
+// syncPolicy resolves the book's policy: an explicit choice from `kscribbler books`, then a kscrib:nosync note,
+// then the SYNC_EXCLUDE patterns. Books matching none of them are always synced.
+func (book Book) syncPolicy() (string, string) {
+	if book.SyncPolicy.Valid && book.SyncPolicy.String != "" {
+		return book.SyncPolicy.String, "set with kscribbler books"
+	}
+	if book.NoSyncNote {
+		return syncPolicyNever, noSyncDirective + " note"
+	}
+	for _, pattern := range syncExcludePatterns {
+		if pattern.MatchString(book.Title.String) || pattern.MatchString(book.BookID) {
+			return syncPolicyNever, "SYNC_EXCLUDE pattern " + pattern.String()
+		}
+	}
+	return syncPolicyAlways, "default"
+}
+
+// filterBooksBySyncPolicy drops books that must not be synced. Books with the ask policy are kept only when
+// the sync was asked for that book.
+func filterBooksBySyncPolicy(books []Book, explicit bool) []Book {
+	var allowed []Book
+	for _, book := range books {
+		policy, reason := book.syncPolicy()
+		switch {
+		case policy == syncPolicyNever:
+			slog.Info("Skipping book: sync policy is never", "title", book.Title.String, "reason", reason)
+		case policy == syncPolicyAsk && !explicit:
+			slog.Info("Skipping book: sync policy is ask", "title", book.Title.String, "sync_with", "kscribbler sync --book "+book.BookID)
+		default:
+			allowed = append(allowed, book)
+		}
+	}
+	return allowed
+}
+
+// setSyncPolicy stores an explicit policy for a book. An empty policy clears it so notes and patterns apply again.
+func setSyncPolicy(bookID string, policy string) error {
+	var value any
+	switch policy {
+	case syncPolicyAlways, syncPolicyNever, syncPolicyAsk:
+		value = policy
+	case "":
+	default:
+		return fmt.Errorf("unknown sync policy %q", policy)
+	}
+
+	result, err := kscribblerDB.Exec(`UPDATE book SET sync_policy = ? WHERE book_id = ?;`, value, bookID)
+	if err != nil {
+		return fmt.Errorf("failed to update sync policy: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no book with id %q, see `kscribbler books`", bookID)
+	}
+	return nil
+}
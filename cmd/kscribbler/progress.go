@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// SYNC_PROGRESS: set the Hardcover status, progress and reading dates of matched books from Nickel.
+var syncProgress bool
+
+// SYNC_PROGRESS_ADD_BOOKS: add books that are not in the user's Hardcover library yet. Otherwise only books
+// already in the library are updated.
+var progressAddBooks bool
+
+// errNotInLibrary is returned for a book that is not in the user's Hardcover library with SYNC_PROGRESS_ADD_BOOKS off.
+var errNotInLibrary = errors.New("book is not in your Hardcover library")
+
+// synced_progress of a book left out because it is not in the library, followed by its fingerprint, so it is not
+// looked up again until its progress changes or SYNC_PROGRESS_ADD_BOOKS is turned on.
+const notInLibraryPrefix = "not_in_library|"
+
+// Hardcover user_book status ids.
+const (
+	statusWantToRead = 1
+	statusReading    = 2
+	statusRead       = 3
+)
+
+// Kobo content.ReadStatus values.
+const (
+	koboUnread   = 0
+	koboReading  = 1
+	koboFinished = 2
+)
+
+// ReadingProgress is what Nickel knows about reading a matched book.
+type ReadingProgress struct {
+	Book
+	ReadStatus     int             `db:"read_status"`
+	PercentRead    sql.NullFloat64 `db:"percent_read"`
+	DateLastRead   sql.NullString  `db:"date_last_read"`
+	StartedAt      sql.NullString  `db:"started_at"`
+	FinishedAt     sql.NullString  `db:"finished_at"`
+	SyncedProgress sql.NullString  `db:"synced_progress"`
+}
+
+// hardcoverUserBook is the user's copy of a book on Hardcover with its most recent read.
+type hardcoverUserBook struct {
+	ID       int `json:"id"`
+	StatusID int `json:"status_id"`
+	Reads    []struct {
+		ID            int     `json:"id"`
+		StartedAt     *string `json:"started_at"`
+		FinishedAt    *string `json:"finished_at"`
+		ProgressPages *int    `json:"progress_pages"`
+	} `json:"user_book_reads"`
+}
+
+// loadReadingProgress joins matched Nickel books with their reading state in KoboReader.sqlite, for every book or
+// only bookID, leaving out books whose sync policy excludes them. kscribblerDB must have koboDB attached.
+func loadReadingProgress(bookID string) ([]ReadingProgress, error) {
+	// start and finish times are only recorded by newer firmware
+	startedAt, finishedAt := "NULL", "NULL"
+	if columnExists(kscribblerDB, "koboDB", "content", "LastTimeStartedReading") {
+		startedAt = "c.LastTimeStartedReading"
+	}
+	if columnExists(kscribblerDB, "koboDB", "content", "LastTimeFinishedReading") {
+		finishedAt = "c.LastTimeFinishedReading"
+	}
+
+	var progress []ReadingProgress
+	err := kscribblerDB.Select(&progress, `
+		SELECT
+			b.book_id,
+			b.book_title,
+			b.hardcover_id,
+			b.hardcover_edition,
+			b.hardcover_pages,
+			b.sync_policy,
+			`+noSyncNoteColumn+`,
+			b.synced_progress,
+			COALESCE(c.ReadStatus, 0) AS read_status,
+			c.___PercentRead AS percent_read,
+			c.DateLastRead AS date_last_read,
+			`+startedAt+` AS started_at,
+			`+finishedAt+` AS finished_at
+		FROM book b
+		JOIN koboDB.content c ON c.ContentID = b.book_id AND c.ContentType = 6
+		WHERE b.match_state = ?
+		AND b.source = 'nickel'
+		AND (? = '' OR b.book_id = ?)
+		ORDER BY b.book_id;
+	`, matchStateMatched, bookID, bookID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load reading progress: %w", err)
+	}
+
+	books := make([]Book, len(progress))
+	for i, p := range progress {
+		books[i] = p.Book
+	}
+	allowed := make(map[string]bool)
+	for _, book := range filterBooksBySyncPolicy(books, bookID != "") {
+		allowed[book.BookID] = true
+	}
+
+	var result []ReadingProgress
+	for _, p := range progress {
+		if allowed[p.BookID] {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+// openProgressDatabases connects kscribblerDB with KoboReader.sqlite attached for the progress sync. It reports
+// false when there is no KoboReader.sqlite, as when only other sources are configured.
+func openProgressDatabases() (bool, error) {
+	if _, err := os.Stat(koboDBPath); err != nil {
+		slog.Info("No KoboReader.sqlite, skipping reading progress", "path", koboDBPath)
+		return false, nil
+	}
+
+	kscribblerDB = connectKscribblerDB()
+	if err := attachKoboDB(kscribblerDB); err != nil {
+		kscribblerDB.Close()
+		return false, fmt.Errorf("failed to attach Kobo database %s: %w", koboDBPath, err)
+	}
+	return true, nil
+}
+
+// status maps Nickel's read status to a Hardcover status.
+func (p ReadingProgress) status() int {
+	switch p.ReadStatus {
+	case koboFinished:
+		return statusRead
+	case koboReading:
+		return statusReading
+	}
+	return statusWantToRead
+}
+
+// progressPages is the page of the Hardcover edition the reader is on, or 0 when the edition's page count is unknown.
+func (p ReadingProgress) progressPages() int {
+	if !p.HardcoverPages.Valid || p.HardcoverPages.Int64 <= 0 {
+		return 0
+	}
+	if p.ReadStatus == koboFinished {
+		return int(p.HardcoverPages.Int64)
+	}
+	percent := min(max(p.PercentRead.Float64, 0), 100)
+	return int(math.Round(percent / 100 * float64(p.HardcoverPages.Int64)))
+}
+
+// startedDate and finishedDate are the reading dates Hardcover records, as YYYY-MM-DD, or empty when unknown.
+func (p ReadingProgress) startedDate() string {
+	if p.ReadStatus == koboUnread {
+		return ""
+	}
+	return koboDate(p.StartedAt.String)
+}
+
+func (p ReadingProgress) finishedDate() string {
+	if p.ReadStatus != koboFinished {
+		return ""
+	}
+	if date := koboDate(p.FinishedAt.String); date != "" {
+		return date
+	}
+	return koboDate(p.DateLastRead.String)
+}
+
+// koboDate reduces a Nickel timestamp such as 2024-01-31T21:04:05Z to its date.
+func koboDate(timestamp string) string {
+	if len(timestamp) < len("2006-01-02") {
+		return ""
+	}
+	date := timestamp[:len("2006-01-02")]
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return ""
+	}
+	return date
+}
+
+// fingerprint identifies the reading state last sent to Hardcover so unchanged books are not sent again.
+func (p ReadingProgress) fingerprint() string {
+	return fmt.Sprintf("%d|%d|%d|%s|%s", p.status(), p.HardcoverEdition, p.progressPages(), p.startedDate(), p.finishedDate())
+}
+
+// upToDate reports whether Hardcover already has this reading state, or the book was left out for not being in
+// the library and nothing changed since.
+func (p ReadingProgress) upToDate() bool {
+	return p.SyncedProgress.String == p.fingerprint() ||
+		(!progressAddBooks && p.SyncedProgress.String == notInLibraryPrefix+p.fingerprint())
+}
+
+// describe summarizes the progress sent to Hardcover, e.g. "reading, p. 120 of 300, started 2024-01-31".
+func (p ReadingProgress) describe() string {
+	parts := []string{map[int]string{
+		statusWantToRead: "want to read",
+		statusReading:    "reading",
+		statusRead:       "read",
+	}[p.status()]}
+	if pages := p.progressPages(); pages > 0 {
+		parts = append(parts, fmt.Sprintf("p. %d of %d", pages, p.HardcoverPages.Int64))
+	} else if p.status() == statusReading && p.PercentRead.Valid {
+		parts = append(parts, fmt.Sprintf("%.0f%% (no edition page count, progress not sent)", p.PercentRead.Float64))
+	}
+	if date := p.startedDate(); date != "" {
+		parts = append(parts, "started "+date)
+	}
+	if date := p.finishedDate(); date != "" {
+		parts = append(parts, "finished "+date)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// syncReadingProgress sends the status, progress and dates of every matched book, or only bookID, to Hardcover.
+// Statuses only move forward, so a book read before is not set back to reading. Returns the number of books updated.
+func syncReadingProgress(ctx context.Context, bookID string) (int, error) {
+	ok, err := openProgressDatabases()
+	if !ok {
+		return 0, err
+	}
+	defer kscribblerDB.Close()
+
+	progress, err := loadReadingProgress(bookID)
+	if err != nil {
+		return 0, err
+	}
+
+	client := newHTTPClient()
+	updated := 0
+	for _, p := range progress {
+		if ctx.Err() != nil {
+			slog.Warn("Stopping progress sync", "reason", interruptionReason(ctx))
+			break
+		}
+		if p.upToDate() {
+			continue
+		}
+
+		synced := p.fingerprint()
+		err := p.sync(client, ctx)
+		if errors.Is(err, errNotInLibrary) {
+			slog.Info(
+				"Book is not in your Hardcover library, set SYNC_PROGRESS_ADD_BOOKS=true to add it",
+				"title", p.Title.String,
+				"book", p.BookID,
+			)
+			synced = notInLibraryPrefix + synced
+		} else if err != nil {
+			slog.Error("failed to sync reading progress", "title", p.Title.String, "book", p.BookID, "error", err)
+			continue
+		}
+
+		_, err = kscribblerDB.Exec(`UPDATE book SET synced_progress = ? WHERE book_id = ?;`, synced, p.BookID)
+		if err != nil {
+			slog.Error("failed to record synced progress", "book", p.BookID, "error", err)
+		}
+		if strings.HasPrefix(synced, notInLibraryPrefix) {
+			continue
+		}
+		slog.Info("Synced reading progress", "title", p.Title.String, "progress", p.describe())
+		updated++
+	}
+	return updated, nil
+}
+
+// sync brings the user's Hardcover copy of the book up to date with Nickel. A book that is not in the library is
+// only added with SYNC_PROGRESS_ADD_BOOKS, otherwise errNotInLibrary is returned.
+func (p ReadingProgress) sync(client *http.Client, ctx context.Context) error {
+	var data struct {
+		Me []struct {
+			UserBooks []hardcoverUserBook `json:"user_books"`
+		} `json:"me"`
+	}
+	err := postHardcoverQuery(client, ctx, fmt.Sprintf(`
+		query userBook {
+			me {
+				user_books(where: {book_id: {_eq: %d}}) {
+					id
+					status_id
+					user_book_reads(order_by: {id: desc}, limit: 1) {
+						id
+						started_at
+						finished_at
+						progress_pages
+					}
+				}
+			}
+		}`, p.HardcoverID), nil, &data)
+	if err != nil {
+		return err
+	}
+	if len(data.Me) == 0 {
+		return fmt.Errorf("hardcover did not return the current user")
+	}
+
+	status := p.status()
+	var userBook hardcoverUserBook
+	if len(data.Me[0].UserBooks) == 0 {
+		if !progressAddBooks {
+			return errNotInLibrary
+		}
+		userBook.StatusID = status
+		userBook.ID, err = hardcoverMutation(client, ctx, "insert_user_book", fmt.Sprintf(
+			`object: {book_id: %d, edition_id: %d, status_id: %d}`,
+			p.HardcoverID, p.HardcoverEdition, status,
+		))
+		if err != nil {
+			return err
+		}
+	} else {
+		userBook = data.Me[0].UserBooks[0]
+		// want to read and reading only move forward; read, paused and did not finish are left as they are
+		if userBook.StatusID < status && userBook.StatusID <= statusReading {
+			_, err = hardcoverMutation(client, ctx, "update_user_book", fmt.Sprintf(
+				`id: %d, object: {status_id: %d}`,
+				userBook.ID, status,
+			))
+			if err != nil {
+				return err
+			}
+			userBook.StatusID = status
+		}
+	}
+
+	if status == statusWantToRead || userBook.StatusID > statusRead {
+		return nil
+	}
+
+	fields := p.readFields(userBook)
+	if len(fields) == 0 {
+		return nil
+	}
+	if len(userBook.Reads) == 0 {
+		fields = append(fields, fmt.Sprintf("edition_id: %d", p.HardcoverEdition))
+		_, err = hardcoverMutation(client, ctx, "insert_user_book_read", fmt.Sprintf(
+			`user_book_id: %d, user_book_read: {%s}`,
+			userBook.ID, strings.Join(fields, ", "),
+		))
+		return err
+	}
+	_, err = hardcoverMutation(client, ctx, "update_user_book_read", fmt.Sprintf(
+		`id: %d, object: {%s}`,
+		userBook.Reads[0].ID, strings.Join(fields, ", "),
+	))
+	return err
+}
+
+// readFields lists the user_book_read fields that Nickel knows better than the user's latest read on Hardcover.
+// Progress never goes backwards and dates already set on Hardcover are kept. A read that is already finished is
+// only completed, since a re-read in Nickel does not start a new read on Hardcover.
+func (p ReadingProgress) readFields(userBook hardcoverUserBook) []string {
+	var fields []string
+	started, finished, pages := "", "", 0
+	if len(userBook.Reads) > 0 {
+		read := userBook.Reads[0]
+		if read.StartedAt != nil {
+			started = *read.StartedAt
+		}
+		if read.FinishedAt != nil {
+			finished = *read.FinishedAt
+		}
+		if read.ProgressPages != nil {
+			pages = *read.ProgressPages
+		}
+	}
+
+	if finished != "" {
+		return nil
+	}
+	if progress := p.progressPages(); progress > pages {
+		fields = append(fields, fmt.Sprintf("progress_pages: %d", progress))
+	}
+	if date := p.startedDate(); date != "" && started == "" {
+		fields = append(fields, fmt.Sprintf("started_at: %q", date))
+	}
+	if date := p.finishedDate(); date != "" {
+		fields = append(fields, fmt.Sprintf("finished_at: %q", date))
+	}
+	return fields
+}
+
+// hardcoverMutation runs a mutation returning Hardcover's {id error} result and returns the id.
+func hardcoverMutation(client *http.Client, ctx context.Context, name string, arguments string) (int, error) {
+	var data map[string]*struct {
+		ID    int     `json:"id"`
+		Error *string `json:"error"`
+	}
+	query := fmt.Sprintf(`mutation %[1]s { %[1]s(%[2]s) { id error } }`, name, arguments)
+	err := postHardcoverQuery(client, ctx, query, nil, &data)
+	if err != nil {
+		return 0, err
+	}
+
+	result := data[name]
+	if result == nil {
+		return 0, fmt.Errorf("hardcover returned no result for %s", name)
+	}
+	if result.Error != nil && *result.Error != "" {
+		return 0, fmt.Errorf("hardcover %s error: %s", name, *result.Error)
+	}
+	return result.ID, nil
+}
+
+// printReadingProgress shows what syncReadingProgress would send, without contacting Hardcover.
+func printReadingProgress(bookID string) error {
+	ok, err := openProgressDatabases()
+	if !ok {
+		return err
+	}
+	defer kscribblerDB.Close()
+
+	progress, err := loadReadingProgress(bookID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("\n===== Reading progress =====")
+	for _, p := range progress {
+		state := "changed"
+		if p.SyncedProgress.String == p.fingerprint() {
+			state = "unchanged"
+		} else if p.upToDate() {
+			state = "not in your Hardcover library"
+		}
+		fmt.Printf("%s: %s (%s)\n", p.Title.String, p.describe(), state)
+	}
+	return nil
+}
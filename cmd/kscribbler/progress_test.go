@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// readingProgress builds the progress of a book with a 300 page edition.
+func readingProgress(readStatus int, percent float64, startedAt string, finishedAt string, lastRead string) ReadingProgress {
+	str := func(s string) sql.NullString { return sql.NullString{String: s, Valid: s != ""} }
+	p := ReadingProgress{
+		ReadStatus:   readStatus,
+		PercentRead:  sql.NullFloat64{Float64: percent, Valid: true},
+		StartedAt:    str(startedAt),
+		FinishedAt:   str(finishedAt),
+		DateLastRead: str(lastRead),
+	}
+	p.HardcoverEdition = 55
+	p.HardcoverPages = sql.NullInt64{Int64: 300, Valid: true}
+	return p
+}
+
+func TestReadingProgressStatus(t *testing.T) {
+	tests := []struct {
+		readStatus int
+		want       int
+	}{
+		{koboUnread, statusWantToRead},
+		{koboReading, statusReading},
+		{koboFinished, statusRead},
+		{7, statusWantToRead},
+	}
+
+	for _, tt := range tests {
+		if got := (ReadingProgress{ReadStatus: tt.readStatus}).status(); got != tt.want {
+			t.Errorf("status() of ReadStatus %d = %d, want %d", tt.readStatus, got, tt.want)
+		}
+	}
+}
+
+func TestProgressPages(t *testing.T) {
+	noPages := readingProgress(koboReading, 40, "", "", "")
+	noPages.HardcoverPages = sql.NullInt64{}
+	zeroPages := readingProgress(koboReading, 40, "", "", "")
+	zeroPages.HardcoverPages = sql.NullInt64{Int64: 0, Valid: true}
+
+	tests := []struct {
+		name     string
+		progress ReadingProgress
+		want     int
+	}{
+		{"reading", readingProgress(koboReading, 40, "", "", ""), 120},
+		{"rounded", readingProgress(koboReading, 33.4, "", "", ""), 100},
+		{"finished", readingProgress(koboFinished, 97, "", "", ""), 300},
+		{"over 100 percent", readingProgress(koboReading, 140, "", "", ""), 300},
+		{"negative percent", readingProgress(koboReading, -5, "", "", ""), 0},
+		{"unknown page count", noPages, 0},
+		{"zero page count", zeroPages, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.progress.progressPages(); got != tt.want {
+				t.Errorf("progressPages() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		progress ReadingProgress
+		userBook string
+		want     []string
+	}{
+		{
+			name:     "first read",
+			progress: readingProgress(koboReading, 40, "2024-01-31T21:04:05Z", "", ""),
+			userBook: `{"id": 1, "user_book_reads": []}`,
+			want:     []string{"progress_pages: 120", `started_at: "2024-01-31"`},
+		},
+		{
+			name:     "progress moves forward, the start date is kept",
+			progress: readingProgress(koboReading, 40, "2024-01-31T21:04:05Z", "", ""),
+			userBook: `{"id": 1, "user_book_reads": [{"id": 2, "started_at": "2024-01-01", "progress_pages": 90}]}`,
+			want:     []string{"progress_pages: 120"},
+		},
+		{
+			name:     "progress never goes backwards",
+			progress: readingProgress(koboReading, 40, "", "", ""),
+			userBook: `{"id": 1, "user_book_reads": [{"id": 2, "progress_pages": 150}]}`,
+			want:     nil,
+		},
+		{
+			name:     "finished in Nickel",
+			progress: readingProgress(koboFinished, 100, "2024-01-31T21:04:05Z", "", "2024-02-10T08:00:00Z"),
+			userBook: `{"id": 1, "user_book_reads": [{"id": 2, "started_at": "2024-01-31", "progress_pages": 200}]}`,
+			want:     []string{"progress_pages: 300", `finished_at: "2024-02-10"`},
+		},
+		{
+			name:     "a finished read is left alone",
+			progress: readingProgress(koboReading, 10, "2025-03-01T10:00:00Z", "", ""),
+			userBook: `{"id": 1, "user_book_reads": [{"id": 2, "started_at": "2024-01-31", "finished_at": "2024-02-10"}]}`,
+			want:     nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var userBook hardcoverUserBook
+			if err := json.Unmarshal([]byte(tt.userBook), &userBook); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.progress.readFields(userBook); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readFields() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		name     string
+		progress ReadingProgress
+		want     string
+	}{
+		{"unread", readingProgress(koboUnread, 0, "2024-01-31T21:04:05Z", "", ""), "1|55|0||"},
+		{"reading", readingProgress(koboReading, 40, "2024-01-31T21:04:05Z", "", ""), "2|55|120|2024-01-31|"},
+		{
+			"finished",
+			readingProgress(koboFinished, 100, "2024-01-31T21:04:05Z", "2024-02-09T23:00:00Z", "2024-02-10T08:00:00Z"),
+			"3|55|300|2024-01-31|2024-02-09",
+		},
+		{
+			"finished without a finish date",
+			readingProgress(koboFinished, 100, "2024-01-31T21:04:05Z", "", "2024-02-10T08:00:00Z"),
+			"3|55|300|2024-01-31|2024-02-10",
+		},
+		{"invalid dates", readingProgress(koboReading, 40, "yesterday", "", ""), "2|55|120||"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.progress.fingerprint(); got != tt.want {
+				t.Errorf("fingerprint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
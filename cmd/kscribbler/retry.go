@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Failed uploads are retried after retryBaseDelay, doubling with every attempt up to retryMaxDelay.
+// After maxUploadAttempts failures a quote is left alone until `kscribbler retry --failed`.
+const retryBaseDelay = 5 * time.Minute
+const retryMaxDelay = 24 * time.Hour
+
+var maxUploadAttempts = 8
+
+// retryDelay returns how long to wait before the next upload after the given number of failed attempts.
+func retryDelay(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMaxDelay)
+}
+
+// readyQuoteFilter is the SQL condition for quotes, or markers, of alias that are due for an upload attempt.
+func readyQuoteFilter(alias string) string {
+	return fmt.Sprintf(
+		`%[1]s.kscribbler_uploaded = 0 AND %[1]s.attempts < %[2]d
+		AND (%[1]s.next_attempt_at IS NULL OR %[1]s.next_attempt_at <= strftime('%%s', 'now'))`,
+		alias,
+		maxUploadAttempts,
+	)
+}
+
+// recordFailure stores the upload error and schedules the next attempt.
+func (bm Bookmark) recordFailure(uploadErr error) {
+	scheduleRetry("quote", bm.BookmarkID, bm.bookmarkIDs(), bm.Attempts+1, uploadErr)
+}
+
+// recordFailure stores the upload error of the marker and schedules the next attempt.
+func (m Marker) recordFailure(uploadErr error) {
+	scheduleRetry("marker", m.BookmarkID, []string{m.BookmarkID}, m.Attempts+1, uploadErr)
+}
+
+// scheduleRetry records the failed attempt of the bookmark ids in table and when to try again.
+func scheduleRetry(table string, bookmarkID string, bookmarkIDs []string, attempts int, uploadErr error) {
+	nextAttempt := time.Now().Add(retryDelay(attempts))
+
+	query, args, err := sqlx.In(`
+		UPDATE `+table+`
+		SET attempts = ?, last_error = ?, next_attempt_at = ?
+		WHERE bookmark_id IN (?);
+	`, attempts, uploadErr.Error(), nextAttempt.Unix(), bookmarkIDs)
+	if err == nil {
+		_, err = kscribblerDB.Exec(query, args...)
+	}
+	if err != nil {
+		slog.Error("failed to record upload failure", "bookmark", bookmarkID, "error", err)
+		return
+	}
+
+	if attempts >= maxUploadAttempts {
+		slog.Warn(
+			"Bookmark failed too often and will not be retried until `kscribbler retry --failed`",
+			"bookmark", bookmarkID,
+			"attempts", attempts,
+		)
+		return
+	}
+	slog.Info("Bookmark will be retried", "bookmark", bookmarkID, "after", nextAttempt.Format(time.RFC3339))
+}
+
+// resetRetries makes quotes and markers waiting for their backoff due now. With failed, those that ran out of
+// attempts are given a fresh set of attempts too. Returns the number reset.
+func resetRetries(failed bool) int64 {
+	var total int64
+	for _, table := range []string{"quote", "marker"} {
+		var result sql.Result
+		var err error
+		if failed {
+			result, err = kscribblerDB.Exec(`
+				UPDATE ` + table + `
+				SET next_attempt_at = NULL, attempts = 0
+				WHERE kscribbler_uploaded = 0 AND attempts > 0;
+			`)
+		} else {
+			result, err = kscribblerDB.Exec(`
+				UPDATE `+table+`
+				SET next_attempt_at = NULL
+				WHERE kscribbler_uploaded = 0 AND attempts > 0 AND attempts < ?;
+			`, maxUploadAttempts)
+		}
+		if err != nil {
+			fatal("failed to reset "+table+" retries", "error", err)
+		}
+
+		rowsAffected, _ := result.RowsAffected()
+		total += rowsAffected
+	}
+	return total
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Source is a store of highlights that can be imported into the book and quote tables.
+// Everything after import (ISBN resolution, Hardcover matching, journal posting) is shared.
+type Source interface {
+	// Name is recorded in the source column of the rows the source imports.
+	Name() string
+	// Populate imports the source's books and quotes into kscribblerDB.
+	Populate() error
+}
+
+// nickelSource imports highlights from Nickel's KoboReader.sqlite by attaching it to kscribblerDB.
+type nickelSource struct{}
+
+func (source nickelSource) Name() string {
+	return "nickel"
+}
+
+// Populate copies books, quotes, dogears, markups and ISBNs out of KoboReader.sqlite.
+func (source nickelSource) Populate() error {
+	if _, err := os.Stat(koboDBPath); err != nil {
+		return fmt.Errorf("KoboReader.sqlite is not readable at %s: %w", koboDBPath, err)
+	}
+
+	populateBookTable()
+	populateQuoteTable()
+	populateMarkerTable()
+	syncISBNsFromKoboDB()
+	return nil
+}
+
+// configuredSources returns the sources enabled by the environment.
+// Nickel is used whenever KoboReader.sqlite exists so a desktop run can rely on file sources alone.
+func configuredSources() []Source {
+	var sources []Source
+
+	if _, err := os.Stat(koboDBPath); err == nil {
+		sources = append(sources, nickelSource{})
+	} else if errors.Is(err, os.ErrNotExist) {
+		slog.Info("No KoboReader.sqlite, skipping Nickel highlights", "path", koboDBPath)
+	} else {
+		slog.Error("Unable to read KoboReader.sqlite", "path", koboDBPath, "error", err)
+	}
+
+	if koreaderLibrary != "" {
+		sources = append(sources, koreaderSource{root: koreaderLibrary})
+	}
+	if kindleClippingsPath != "" {
+		sources = append(sources, kindleSource{path: kindleClippingsPath})
+	}
+	if calibreAnnotationsPath != "" {
+		sources = append(sources, calibreSource{path: calibreAnnotationsPath})
+	}
+
+	return sources
+}
+
+// populateFromSources runs every configured source.
+func populateFromSources() {
+	sources := configuredSources()
+	if len(sources) == 0 {
+		slog.Warn("No highlight sources are configured")
+	}
+
+	for _, source := range sources {
+		slog.Info("Importing highlights", "source", source.Name())
+		if err := source.Populate(); err != nil {
+			slog.Error("failed to import highlights", "source", source.Name(), "error", err)
+		}
+	}
+}
+
+// insertImportedBooks stores books parsed by a file-based source, tagging rows with the source name.
+func insertImportedBooks(sourceName string, books []ImportedBook) {
+	kscribblerDB := connectKscribblerDB()
+	defer kscribblerDB.Close()
+
+	for _, book := range books {
+		if len(book.Highlights) == 0 {
+			continue
+		}
+
+		var isbn any
+		if book.ISBN != "" {
+			isbn = book.ISBN
+		}
+
+		_, err := kscribblerDB.Exec(`
+			INSERT INTO book(book_id, book_title, isbn, source)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT(book_id) DO UPDATE SET isbn = COALESCE(book.isbn, excluded.isbn);
+		`, book.BookID, book.Title, isbn, sourceName)
+		if err != nil {
+			slog.Error("failed to insert book", "source", sourceName, "title", book.Title, "error", err)
+			continue
+		}
+
+		inserted := 0
+		for _, h := range book.Highlights {
+			entryType := "highlight"
+			var note any
+			if h.Note != "" {
+				entryType = "note"
+				note = h.Note
+			}
+			var page any
+			if h.Page > 0 {
+				page = h.Page
+			}
+
+			// kscrib: notes are directives for kscribbler, not journal entries
+			uploaded := 0
+			if strings.Contains(strings.ToLower(h.Note), "kscrib") {
+				uploaded = 1
+			}
+
+			result, err := kscribblerDB.Exec(`
+				INSERT OR IGNORE INTO quote(
+					book_id, bookmark_id, type, quote, annotation, page, chapter, created_at, kscribbler_uploaded, source
+				)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+			`, book.BookID, h.BookmarkID, entryType, h.Text, note, page, nullString(h.Chapter), nullString(h.Datetime),
+				uploaded, sourceName)
+			if err != nil {
+				slog.Error("failed to insert highlight", "source", sourceName, "origin", book.Origin, "error", err)
+				continue
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				inserted++
+			}
+		}
+
+		if inserted > 0 {
+			slog.Info("Imported highlights", "source", sourceName, "highlights", inserted, "title", book.Title)
+		}
+	}
+}
+
+// nullString stores an empty string as NULL.
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"regexp"
 	"strings"
 
@@ -17,42 +17,213 @@ type Book struct {
 	FoundISBN        sql.NullString `db:"isbn"`
 	SimpleISBN       simpleISBN.ISBN
 	Bookmarks        []Bookmark
-	HardcoverID      int `db:"hardcover_id"`
-	HardcoverEdition int `db:"hardcover_edition"`
-	PendingQuotes    int `db:"pending_quotes"`
+	Markers          []Marker
+	HardcoverID      int            `db:"hardcover_id"`
+	HardcoverEdition int            `db:"hardcover_edition"`
+	PendingQuotes    int            `db:"pending_quotes"`
+	Source           string         `db:"source"`
+	SyncPolicy       sql.NullString `db:"sync_policy"`
+	NoSyncNote       bool           `db:"nosync_note"`
+	MatchState       string         `db:"match_state"`
+	MatchError       sql.NullString `db:"match_error"`
+	Language         sql.NullString `db:"language"`
+	EditionReason    sql.NullString `db:"edition_reason"`
+	HardcoverPages   sql.NullInt64  `db:"hardcover_pages"`
+}
+
+// Outcome of uploadPendingQuotes, logged at the end of every sync even when it is cut short.
+type SyncSummary struct {
+	Books    int
+	Uploaded int
+	// dogears and markups uploaded
+	Markers     int
+	Failed      int
+	Skipped     int
+	Pending     int
+	Unmatched   int
+	Progress    int
+	Interrupted string
+}
+
+// Short result shown on the device, e.g. "12 quotes uploaded to 3 books, 2 failed, 1 book unmatched"
+func (summary SyncSummary) Notification() string {
+	uploaded := fmt.Sprintf("%d %s", summary.Uploaded, plural(summary.Uploaded, "quote", "quotes"))
+	if summary.Markers > 0 {
+		uploaded += fmt.Sprintf(" and %d %s", summary.Markers, plural(summary.Markers, "dogear or markup", "dogears and markups"))
+	}
+	result := fmt.Sprintf("%s uploaded to %d %s", uploaded, summary.Books, plural(summary.Books, "book", "books"))
+	if summary.Failed > 0 {
+		result += fmt.Sprintf(", %d failed", summary.Failed)
+	}
+	if summary.Unmatched > 0 {
+		result += fmt.Sprintf(", %d %s unmatched", summary.Unmatched, plural(summary.Unmatched, "book", "books"))
+	}
+	if summary.Progress > 0 {
+		result += fmt.Sprintf(", progress of %d %s synced", summary.Progress, plural(summary.Progress, "book", "books"))
+	}
+	if summary.Interrupted != "" {
+		result = fmt.Sprintf("Stopped early (%s): %s", summary.Interrupted, result)
+	}
+	return result
+}
+
+// Print a one line summary of the sync
+func (summary SyncSummary) String() string {
+	result := fmt.Sprintf(
+		"%d quotes and %d dogears and markups uploaded to %d books, %d failed, %d skipped, %d books unmatched",
+		summary.Uploaded,
+		summary.Markers,
+		summary.Books,
+		summary.Failed,
+		summary.Skipped,
+		summary.Unmatched,
+	)
+	if summary.Interrupted != "" {
+		result = fmt.Sprintf("Sync stopped early (%s): %s, %d left for the next sync", summary.Interrupted, result, summary.Pending)
+	} else {
+		result = "Sync finished: " + result
+	}
+	return result
+}
+
+func plural(n int, singular string, pluralForm string) string {
+	if n == 1 {
+		return singular
+	}
+	return pluralForm
+}
+
+// Summary counts of the kscribbler database shown by `kscribbler status`.
+type LibraryStatus struct {
+	Books          int `db:"books"`
+	MatchedBooks   int `db:"matched_books"`
+	Quotes         int `db:"quotes"`
+	UploadedQuotes int `db:"uploaded_quotes"`
+	PendingQuotes  int `db:"pending_quotes"`
+	RetryingQuotes int `db:"retrying_quotes"`
+	FailedQuotes   int `db:"failed_quotes"`
+}
+
+// Represents a row of the sync_run table shown by `kscribbler history`.
+type SyncRun struct {
+	RunID      int64          `db:"run_id"`
+	Command    string         `db:"command"`
+	Version    string         `db:"version"`
+	StartedAt  int64          `db:"started_at"`
+	FinishedAt sql.NullInt64  `db:"finished_at"`
+	NewBooks   int            `db:"new_books"`
+	NewQuotes  int            `db:"new_quotes"`
+	Uploaded   int            `db:"uploaded"`
+	Failed     int            `db:"failed"`
+	Skipped    int            `db:"skipped"`
+	Unmatched  int            `db:"unmatched"`
+	Error      sql.NullString `db:"error"`
+}
+
+// Represents a single upload attempt of a quote recorded in upload_event.
+type UploadEvent struct {
+	EventID          int64          `db:"event_id"`
+	RunID            sql.NullInt64  `db:"run_id"`
+	Version          sql.NullString `db:"version"`
+	BookmarkID       string         `db:"bookmark_id"`
+	BookID           string         `db:"book_id"`
+	HardcoverID      sql.NullInt64  `db:"hardcover_id"`
+	HardcoverEdition sql.NullInt64  `db:"hardcover_edition"`
+	CreatedAt        int64          `db:"created_at"`
+	Uploaded         bool           `db:"uploaded"`
+	Error            sql.NullString `db:"error"`
 }
 
 // Represents the KoboReader.sqlite for a quote or annotation.
 type Bookmark struct {
-	BookmarkID         string         `db:"bookmark_id"`
-	BookID             string         `db:"book_id"`
-	Quote              sql.NullString `db:"quote"`
-	Annotation         sql.NullString `db:"annotation"`
-	Page               sql.NullInt64  `db:"page"`
-	Type               string         `db:"type"`
-	KscribblerUploaded bool           `db:"kscribbler_uploaded"`
+	BookmarkID         string          `db:"bookmark_id"`
+	BookID             string          `db:"book_id"`
+	Quote              sql.NullString  `db:"quote"`
+	Annotation         sql.NullString  `db:"annotation"`
+	Page               sql.NullInt64   `db:"page"`
+	Position           sql.NullFloat64 `db:"position"`
+	EditionPages       sql.NullInt64   `db:"edition_pages"`
+	Chapter            sql.NullString  `db:"chapter"`
+	CreatedAt          sql.NullString  `db:"created_at"`
+	BookTitle          sql.NullString  `db:"book_title"`
+	Type               string          `db:"type"`
+	Color              sql.NullInt64   `db:"color"`
+	ContentID          sql.NullString  `db:"content_id"`
+	StartPath          sql.NullString  `db:"start_path"`
+	StartOffset        sql.NullInt64   `db:"start_offset"`
+	EndPath            sql.NullString  `db:"end_path"`
+	EndOffset          sql.NullInt64   `db:"end_offset"`
+	KscribblerUploaded bool            `db:"kscribbler_uploaded"`
+	Attempts           int             `db:"attempts"`
+	LastError          sql.NullString  `db:"last_error"`
+	NextAttemptAt      sql.NullInt64   `db:"next_attempt_at"`
+	UploadedParts      int             `db:"uploaded_parts"`
+	// bookmarks combined into this one by MERGE_HIGHLIGHTS
+	MergedIDs []string `db:"-"`
+}
+
+// Represents a Kobo dogear or handwritten markup, a bookmark without highlighted text.
+type Marker struct {
+	BookmarkID         string          `db:"bookmark_id"`
+	BookID             string          `db:"book_id"`
+	Type               string          `db:"type"`
+	Chapter            sql.NullString  `db:"chapter"`
+	Position           sql.NullFloat64 `db:"position"`
+	Page               sql.NullInt64   `db:"page"`
+	EditionPages       sql.NullInt64   `db:"edition_pages"`
+	CreatedAt          sql.NullString  `db:"created_at"`
+	MarkupFile         sql.NullString  `db:"markup_file"`
+	KscribblerUploaded bool            `db:"kscribbler_uploaded"`
+	Attempts           int             `db:"attempts"`
 }
 
-// http response structure supporting books and reading journal insertions for hardcover.app
+// Represents a highlight selected for the Anki deck export.
+type AnkiCard struct {
+	BookmarkID string         `db:"bookmark_id"`
+	Quote      string         `db:"quote"`
+	Annotation sql.NullString `db:"annotation"`
+	Color      sql.NullInt64  `db:"color"`
+	Page       sql.NullInt64  `db:"page"`
+	Title      sql.NullString `db:"book_title"`
+}
+
+// Represents a book parsed from a file-based Source (KOReader sidecar, Kindle clippings, Calibre export).
+type ImportedBook struct {
+	BookID     string
+	Title      string
+	ISBN       string
+	Origin     string
+	Highlights []ImportedHighlight
+}
+
+// Represents a single imported highlight and its optional note.
+type ImportedHighlight struct {
+	BookmarkID string
+	Text       string
+	Note       string
+	Chapter    string
+	Datetime   string
+	Page       int64
+}
+
+// http response structure supporting books and reading journal insertions for hardcover.app. GraphQL errors are
+// handled by postHardcoverQuery, which decodes only Data.
 type Response struct {
-	Errors []struct {
-		Message    string `json:"message"`
-		Extensions struct {
-			Path string `json:"path"`
-			Code string `json:"code"`
-		} `json:"extensions"`
-	} `json:"errors"`
 	Data struct {
 		Books []struct {
-			ID       int    `json:"id"`
-			Title    string `json:"title"`
-			Editions []struct {
-				ID int `json:"id"`
-			} `json:"editions"`
+			ID       int                `json:"id"`
+			Title    string             `json:"title"`
+			Editions []HardcoverEdition `json:"editions"`
+			// a capped sample of the book's ebook editions, see koboToHardcover
+			EbookEditions []HardcoverEdition `json:"ebook_editions"`
 		} `json:"books"`
 		InsertReadingJournal struct {
 			Errors *string `json:"errors"`
 		} `json:"insert_reading_journal"`
+		Me []struct {
+			ID       int    `json:"id"`
+			Username string `json:"username"`
+		} `json:"me"`
 	} `json:"data"`
 }
 
@@ -98,7 +269,7 @@ func (book *Book) SetIsbnFromBook() bool {
 		var isbn *simpleISBN.ISBN
 		var err error
 		var match string
-		log.Println("Checking for ISBN in: ", isbnCandidate)
+		slog.Debug("Checking for ISBN", "text", isbnCandidate)
 		if isbn13Regex.MatchString(isbnCandidate) {
 			match = isbn13Regex.FindString(isbnCandidate)
 		} else if isbn10Regex.MatchString(isbnCandidate) {
@@ -109,26 +280,26 @@ func (book *Book) SetIsbnFromBook() bool {
 
 		isbn, err = simpleISBN.NewISBN(match)
 		if err != nil {
-			log.Printf("ISBN matched from highlight/note but failed to parse:\n%s\n%s", match, err)
+			slog.Warn("ISBN matched from highlight/note but failed to parse", "match", match, "error", err)
 			return false
 		}
 
 		book.SimpleISBN = *isbn
 
-		log.Printf(
-			"Found ISBN for book %s: %s (from bookmark %s)",
-			book.BookID,
-			isbn.ISBN13Number,
-			bm.BookmarkID,
+		slog.Info(
+			"Found ISBN for book",
+			"book", book.BookID,
+			"isbn", isbn.ISBN13Number,
+			"bookmark", bm.BookmarkID,
 		)
 
 		// update the book table with the new isbn
 		updateString := "UPDATE book SET isbn = ? WHERE book_id LIKE ?;"
 		_, err = kscribblerDB.Exec(updateString, isbn.ISBN13Number, "%"+book.BookID+"%")
-		log.Println("Updating content table with ISBN ->", isbn.ISBN13Number)
+		slog.Debug("Updating book table with ISBN", "isbn", isbn.ISBN13Number)
 
 		if err != nil {
-			log.Printf("Failed to update kscribblerDB ISBN for %s: %v", book.Title.String, err)
+			slog.Error("failed to update kscribblerDB ISBN", "title", book.Title.String, "error", err)
 			return false
 		}
 
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Default entry templates, matching the journal entries kscribbler has always posted.
+const (
+	defaultHighlightTemplate = "{{with .Location}}{{.}}\n\n{{end}}{{.Quote}}"
+	defaultNoteTemplate      = "{{with .Location}}{{.}}\n\n{{end}}{{.Quote}}\n\n---\n\n{{.Annotation}}"
+)
+
+// Journal entry templates, replaced by HIGHLIGHT_TEMPLATE and NOTE_TEMPLATE.
+var highlightTemplate = template.Must(newEntryTemplate("HIGHLIGHT_TEMPLATE", defaultHighlightTemplate))
+var noteTemplate = template.Must(newEntryTemplate("NOTE_TEMPLATE", defaultNoteTemplate))
+
+// Represents the values available to journal entry templates.
+type EntryTemplateData struct {
+	Quote      string
+	Annotation string
+	// page number as chosen by PAGE_NUMBERS, 0 when unknown
+	Page int
+	// 0 to 100, -1 when unknown
+	Percentage int
+	// "p. 12", "42%" or empty, the prefix of the default templates
+	Location string
+	Chapter  string
+	// date the highlight was made, formatted as 2006-01-02 when it can be parsed
+	Date  string
+	Title string
+	// yellow, pink, blue, green or empty
+	Color string
+}
+
+// Sample data the templates are validated against at startup.
+var sampleEntryData = EntryTemplateData{
+	Quote:      "It is a truth universally acknowledged...",
+	Annotation: "A note",
+	Page:       12,
+	Percentage: 4,
+	Location:   "p. 12",
+	Chapter:    "Chapter 1",
+	Date:       "2024-01-31",
+	Title:      "Pride and Prejudice",
+	Color:      "yellow",
+}
+
+func newEntryTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+// loadConfiguredTemplates loads HIGHLIGHT_TEMPLATE and NOTE_TEMPLATE from the config. Only commands that render
+// journal entries load them, so a broken template does not stop every other command.
+func loadConfiguredTemplates() error {
+	if err := loadEntryTemplates(os.Getenv("HIGHLIGHT_TEMPLATE"), os.Getenv("NOTE_TEMPLATE")); err != nil {
+		return fmt.Errorf("invalid journal entry template in config.env: %w", err)
+	}
+	return nil
+}
+
+// loadEntryTemplates parses the configured templates and renders them once with sample data so mistakes are
+// reported before any entry is rendered instead of in the middle of a sync.
+func loadEntryTemplates(highlightText string, noteText string) error {
+	parse := func(name string, text string) (*template.Template, error) {
+		tmpl, err := newEntryTemplate(name, text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		if err := tmpl.Execute(&strings.Builder{}, sampleEntryData); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		return tmpl, nil
+	}
+
+	if highlightText != "" {
+		tmpl, err := parse("HIGHLIGHT_TEMPLATE", highlightText)
+		if err != nil {
+			return err
+		}
+		highlightTemplate = tmpl
+	}
+	if noteText != "" {
+		tmpl, err := parse("NOTE_TEMPLATE", noteText)
+		if err != nil {
+			return err
+		}
+		noteTemplate = tmpl
+	}
+	return nil
+}
+
+// templateData gathers what the entry templates can show about the bookmark.
+func (entry Bookmark) templateData() EntryTemplateData {
+	data := EntryTemplateData{
+		Quote:      convertQuotes(strings.TrimSpace(entry.Quote.String)),
+		Annotation: convertQuotes(strings.TrimSpace(entry.Annotation.String)),
+		Page:       entry.pageNumber(),
+		Percentage: -1,
+		Location:   entry.pageLabel(),
+		Chapter:    strings.TrimSpace(entry.Chapter.String),
+		Date:       formatEntryDate(entry.CreatedAt.String),
+		Title:      entry.BookTitle.String,
+	}
+	if entry.Position.Valid {
+		data.Percentage = int(math.Round(entry.Position.Float64 * 100))
+	}
+	if entry.Color.Valid {
+		for name, value := range highlightColors {
+			if int64(value) == entry.Color.Int64 {
+				data.Color = name
+			}
+		}
+	}
+	return data
+}
+
+// Layouts of the creation dates recorded by Nickel, KOReader, Kindle and Calibre.
+var entryDateLayouts = []string{
+	"2006-01-02T15:04:05.000",
+	"2006-01-02T15:04:05Z07:00",
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"Monday, January 2, 2006 3:04:05 PM",
+	"Monday, 2 January 2006 15:04:05",
+}
+
+// formatEntryDate formats a source's creation date as 2006-01-02, keeping it as is when the layout is unknown.
+func formatEntryDate(raw string) string {
+	raw = strings.TrimSpace(raw)
+	for _, layout := range entryDateLayouts {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return t.Format("2006-01-02")
+		}
+	}
+	return raw
+}
+
+// renderEntry executes the highlight or note template for the bookmark. A template that fails on this bookmark
+// falls back to the default so the quote is still uploaded.
+func (entry Bookmark) renderEntry() string {
+	tmpl, fallback := highlightTemplate, defaultHighlightTemplate
+	if entry.Type == "note" {
+		tmpl, fallback = noteTemplate, defaultNoteTemplate
+	}
+
+	data := entry.templateData()
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		slog.Error("failed to render journal entry template, using the default", "bookmark", entry.BookmarkID, "error", err)
+		out.Reset()
+		template.Must(newEntryTemplate(tmpl.Name(), fallback)).Execute(&out, data)
+	}
+	return strings.TrimSpace(out.String())
+}
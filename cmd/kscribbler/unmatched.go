@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/GianniBYoung/simpleISBN"
+)
+
+// listUnmatchedBooks loads books with pending quotes that are not matched to Hardcover, for every book or only bookID.
+func listUnmatchedBooks(bookID string) []Book {
+	var books []Book
+	err := kscribblerDB.Select(&books, `
+		SELECT
+			b.book_id,
+			b.book_title,
+			b.isbn,
+			b.hardcover_id,
+			b.hardcover_edition,
+			b.match_state,
+			b.match_error,
+			b.source,
+			b.sync_policy,
+			`+noSyncNoteColumn+`,
+			(SELECT COUNT(*) FROM quote q WHERE q.book_id = b.book_id AND q.kscribbler_uploaded = 0) AS pending_quotes
+		FROM book b
+		WHERE b.match_state != ?
+		AND EXISTS (SELECT 1 FROM quote q WHERE q.book_id = b.book_id AND q.kscribbler_uploaded = 0)
+		AND (? = '' OR b.book_id = ?)
+		ORDER BY b.book_title;
+	`, matchStateMatched, bookID, bookID)
+	if err != nil {
+		fatal("failed to list unmatched books", "error", err)
+	}
+	return books
+}
+
+// unmatchedReason explains why the book has no Hardcover match.
+func (book Book) unmatchedReason() string {
+	if !book.FoundISBN.Valid || book.FoundISBN.String == "" {
+		return "no ISBN, highlight it or add a kscrib:<isbn> note"
+	}
+	if _, err := simpleISBN.NewISBN(book.FoundISBN.String); err != nil {
+		return fmt.Sprintf("ISBN %s could not be parsed: %v", book.FoundISBN.String, err)
+	}
+	if book.MatchError.Valid {
+		return book.MatchError.String
+	}
+	if book.MatchState == matchStateNotFound {
+		return fmt.Sprintf("ISBN %s is not on Hardcover", book.FoundISBN.String)
+	}
+	return "not looked up on Hardcover yet"
+}
+
+// resolveBookISBN replaces the ISBN of bookID so the next Hardcover lookup uses it.
+func resolveBookISBN(bookID string, rawISBN string) error {
+	isbn, err := simpleISBN.NewISBN(rawISBN)
+	if err != nil {
+		return fmt.Errorf("invalid ISBN %s: %w", rawISBN, err)
+	}
+	value := isbn.ISBN13Number
+	if value == "" {
+		value = isbn.ISBN10Number
+	}
+
+	result, err := kscribblerDB.Exec(`
+		UPDATE book
+		SET isbn = ?, hardcover_id = -1, hardcover_edition = -1, hardcover_pages = NULL, edition_reason = NULL,
+			match_state = ?, match_error = NULL
+		WHERE book_id = ?;
+	`, value, matchStateUnresolved, bookID)
+	if err != nil {
+		return fmt.Errorf("failed to update book %s: %w", bookID, err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no book with id %s", bookID)
+	}
+	return nil
+}
+
+// resolveBookHardcoverIDs sets the Hardcover book and edition of bookID directly.
+func resolveBookHardcoverIDs(bookID string, hardcoverID int, hardcoverEdition int) error {
+	if hardcoverID <= 0 || hardcoverEdition <= 0 {
+		return fmt.Errorf("hardcover book and edition ids must be positive")
+	}
+
+	result, err := kscribblerDB.Exec(`
+		UPDATE book
+		SET hardcover_id = ?, hardcover_edition = ?, hardcover_pages = NULL, edition_reason = ?, match_state = ?,
+			match_error = NULL
+		WHERE book_id = ?;
+	`, hardcoverID, hardcoverEdition, "set by hand with `kscribbler unmatched resolve`", matchStateMatched, bookID)
+	if err != nil {
+		return fmt.Errorf("failed to update book %s: %w", bookID, err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no book with id %s", bookID)
+	}
+	return nil
+}
+
+// resolveBook applies a resolution given as an ISBN or as a Hardcover book id and edition id.
+// It reports whether the book still needs a Hardcover lookup: of its edition for an ISBN, of the edition's page
+// count for ids.
+func resolveBook(bookID string, values []string) (bool, error) {
+	switch len(values) {
+	case 1:
+		return true, resolveBookISBN(bookID, values[0])
+	case 2:
+		hardcoverID, err := strconv.Atoi(values[0])
+		if err != nil {
+			return false, fmt.Errorf("invalid hardcover book id %s", values[0])
+		}
+		hardcoverEdition, err := strconv.Atoi(values[1])
+		if err != nil {
+			return false, fmt.Errorf("invalid hardcover edition id %s", values[1])
+		}
+		return true, resolveBookHardcoverIDs(bookID, hardcoverID, hardcoverEdition)
+	}
+	return false, errUsage
+}
+
+// promptUnmatchedBooks asks for an ISBN or Hardcover ids for every unmatched book, reading answers from in.
+// It returns the ids of the books that need a Hardcover lookup.
+func promptUnmatchedBooks(in io.Reader, out io.Writer) ([]string, error) {
+	scanner := bufio.NewScanner(in)
+	var lookups []string
+
+	for _, book := range listUnmatchedBooks("") {
+		fmt.Fprintf(out, "\n%s (%s)\n  %d pending quotes, %s\n", book.Title.String, book.BookID, book.PendingQuotes, book.unmatchedReason())
+		for {
+			fmt.Fprint(out, "ISBN, or Hardcover book id and edition id (empty to skip): ")
+			if !scanner.Scan() {
+				return lookups, scanner.Err()
+			}
+			values := strings.Fields(scanner.Text())
+			if len(values) == 0 {
+				break
+			}
+
+			needsLookup, err := resolveBook(book.BookID, values)
+			if err != nil {
+				fmt.Fprintf(out, "  %v\n", unmatchedInputError(err))
+				continue
+			}
+			if needsLookup {
+				lookups = append(lookups, book.BookID)
+			}
+			break
+		}
+	}
+	return lookups, nil
+}
+
+func unmatchedInputError(err error) error {
+	if errors.Is(err, errUsage) {
+		return fmt.Errorf("enter one ISBN or two ids")
+	}
+	return err
+}
+
+// lookUpResolvedBooks matches books that were given a new ISBN, and fetches the page count of editions set by
+// hand, right away, leaving them for the next sync when the network is down.
+func lookUpResolvedBooks(ctx context.Context, bookIDs []string) {
+	if len(bookIDs) == 0 {
+		return
+	}
+	requireAuthToken()
+	if err := waitForNetwork(ctx); err != nil {
+		slog.Warn("Hardcover is not reachable, the resolved books will be looked up on the next sync", "error", err)
+		return
+	}
+	for _, bookID := range bookIDs {
+		updateDBWithHardcoverInfo(ctx, bookID)
+	}
+}
+
+// reportUnmatchedBooks logs the books a sync leaves out because they have no Hardcover match and returns how many
+// there are. Books that are not synced by their sync policy are not reported.
+func reportUnmatchedBooks(bookID string) int {
+	count := 0
+	for _, book := range listUnmatchedBooks(bookID) {
+		if policy, _ := book.syncPolicy(); policy != syncPolicyAlways && bookID == "" {
+			continue
+		}
+		slog.Warn(
+			"Skipping book without a Hardcover match, see `kscribbler unmatched`",
+			"title", book.Title.String,
+			"book", book.BookID,
+			"pending_quotes", book.PendingQuotes,
+			"reason", book.unmatchedReason(),
+		)
+		count++
+	}
+	return count
+}
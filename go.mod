@@ -5,6 +5,7 @@ go 1.25.0
 require (
 	github.com/jmoiron/sqlx v1.4.0
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/text v0.36.0
 	modernc.org/sqlite v1.49.1
 )
 
@@ -4,6 +4,9 @@ if [ -f "$KSDEBUG" ]; then
   rm -f $KSDEBUG
 else
   echo showing debug options
-  echo -e "menu_item:main:Kscribbler Init DB (no upload):cmd_output:9999:/opt/bin/kscribbler --init 2>&1| tee -a /mnt/onboard/.adds/kscribbler/kscribbler.log" >> $KSDEBUG
-  echo -e "menu_item:main:Kscribbler Mark All Quotes as Uploaded (no upload):cmd_output:9999:/opt/bin/kscribbler --mark-all-as-uploaded 2>&1 | tee -a /mnt/onboard/.adds/kscribbler/kscribbler.log" >> $KSDEBUG
+  echo -e "menu_item:main:Kscribbler Init DB (no upload):cmd_output:9999:/opt/bin/kscribbler init 2>&1" >> $KSDEBUG
+  echo -e "menu_item:main:Kscribbler Mark All Quotes, Dogears and Markups as Uploaded (no upload):cmd_output:9999:/opt/bin/kscribbler mark --all 2>&1" >> $KSDEBUG
+  echo -e "menu_item:main:Kscribbler Dry Run (no upload):cmd_output:9999:/opt/bin/kscribbler sync --dry-run 2>/dev/null" >> $KSDEBUG
+  echo -e "menu_item:main:Kscribbler Status:cmd_output:9999:/opt/bin/kscribbler status" >> $KSDEBUG
+  echo -e "menu_item:main:Kscribbler Doctor:cmd_output:9999:/opt/bin/kscribbler doctor" >> $KSDEBUG
 fi
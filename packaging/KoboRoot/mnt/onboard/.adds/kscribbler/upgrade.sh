@@ -5,7 +5,7 @@ if [ $? -ne 0 ]; then
 fi
 
 rm -f /mnt/onboard/.kobo/KoboRoot.tgz
-KSCRIBBLER_CURRENT_VERSION=$(/opt/bin/kscribbler --version)
+KSCRIBBLER_CURRENT_VERSION=$(/opt/bin/kscribbler version)
 KSCRIBBLER_CURRENT_HASH=$(wget -q -O - https://github.com/GianniBYoung/kscribbler/releases/download/$KSCRIBBLER_CURRENT_VERSION/checksums.txt)
 KSCRIBBLER_LATEST_HASH=$( wget -q -O - https://github.com/GianniBYoung/kscribbler/releases/latest/download/checksums.txt)
 